@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"yanchuk.nl/hcvault-mashery-api-auth/masherystub"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Serves the local Mashery stub for offline development. The mount config should point token_endpoint and
+// v2_endpoint to this server.
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8980", "address to listen on")
+	apiKey := flag.String("api-key", "stubkey", "package key")
+	secret := flag.String("secret", "stubsecret", "package key secret")
+	areaNid := flag.Int("area-nid", 1, "numeric id of the area")
+	areaId := flag.String("area-id", "00000000-0000-0000-0000-000000000001", "UUID of the area")
+	username := flag.String("username", "stubuser", "name of the user")
+	password := flag.String("password", "stubpassword", "password of the user")
+	flag.Parse()
+
+	stub := masherystub.New()
+	stub.AddPackageKey(masherystub.PackageKey{ApiKey: *apiKey, Secret: *secret, AreaNid: *areaNid})
+	stub.AddUser(masherystub.User{Username: *username, Password: *password, AreaId: *areaId})
+
+	logger := hclog.New(&hclog.LoggerOptions{})
+	logger.Info("Mashery stub is listening", "address", *listen,
+		"token_endpoint", "http://"+*listen+masherystub.TokenPath,
+		"v2_endpoint", "http://"+*listen+masherystub.V2Path)
+
+	if err := http.ListenAndServe(*listen, stub); err != nil {
+		logger.Error("stub shutting down", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+package mashery
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"time"
+)
+
+// Mashery rejects V2 signatures salted with a time that differs too much from the time of Mashery servers. The V2
+// signing time can therefore be corrected either by the offset calibrated against the Date header returned by
+// the V2 endpoint, or by a configured offset. Calibrated offsets are kept in memory for each endpoint.
+
+const (
+	// Duration for which the calibrated offset is reused before the endpoint is asked again.
+	clockCalibrationInterval = 15 * time.Minute
+)
+
+type calibratedOffset struct {
+	Offset       time.Duration
+	CalibratedAt time.Time
+}
+
+// calibrateServerTime measures the offset of the time of the server behind the endpoint from the local time.
+func calibrateServerTime(ctx context.Context, cl *http.Client, endpoint string) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodHead, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := time.Now()
+	resp, err := cl.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	received := time.Now()
+
+	dateHeader := resp.Header.Get("Date")
+	if len(dateHeader) == 0 {
+		return 0, errors.New("server did not return Date header")
+	}
+
+	serverTime, err := http.ParseTime(dateHeader)
+	if err != nil {
+		return 0, errwrap.Wrapf("malformed Date header: {{err}}", err)
+	}
+
+	// The server time is assumed to be taken half-way through the round trip.
+	localTime := sent.Add(received.Sub(sent) / 2)
+	return serverTime.Sub(localTime).Round(time.Second), nil
+}
+
+// serverTimeOffset returns the calibrated offset of the V2 endpoint of the credentials, calibrating it if
+// the offset was not calibrated recently.
+func (b *AuthPlugin) serverTimeOffset(ctx context.Context, s logical.Storage, v3Rec *AuthRec) (time.Duration, error) {
+	cl, t, err := b.httpClientOf(ctx, s, v3Rec)
+	if err != nil {
+		return 0, err
+	}
+	endpoint := t.v2Endpoint()
+
+	b.clockLock.Lock()
+	defer b.clockLock.Unlock()
+
+	if co, ok := b.serverOffsets[endpoint]; ok && time.Since(co.CalibratedAt) < clockCalibrationInterval {
+		return co.Offset, nil
+	}
+
+	offset, err := calibrateServerTime(ctx, cl, endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset != 0 {
+		b.Logger().Info("Calibrated Mashery server time offset", "endpoint", endpoint, "offset", offset)
+	}
+	b.serverOffsets[endpoint] = calibratedOffset{Offset: offset, CalibratedAt: time.Now()}
+	return offset, nil
+}
+
+// v2ClockOffset returns the offset to add to the local time to obtain the time the V2 signature should be salted
+// with. The calibrated offset is preferred; the configured offset is used if the calibration is disabled or fails.
+func (b *AuthPlugin) v2ClockOffset(ctx context.Context, s logical.Storage, v3Rec *AuthRec) (time.Duration, error) {
+	cfg, err := getMountConfig(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.V2CalibrateTime {
+		if offset, err := b.serverTimeOffset(ctx, s, v3Rec); err != nil {
+			// The configured offset is still better than failing the request.
+			b.Logger().Warn("Could not calibrate Mashery server time", "error", err)
+		} else {
+			return offset, nil
+		}
+	}
+
+	return time.Second * time.Duration(cfg.V2ClockOffset), nil
+}
@@ -2,6 +2,7 @@ package mashery
 
 import (
 	"github.com/aliakseiyanchuk/mashery-v3-go-client/v3client"
+	"time"
 )
 
 const (
@@ -15,6 +16,15 @@ const (
 	secretQpsField           = "qps"
 	secretLeaseDurationField = "lease_duration"
 	secretAccessToken        = "access_token"
+	secretV2CapableField     = "v2_capable"
+	secretV3CapableField     = "v3_capable"
+	secretEnforceQpsField    = "enforce_qps"
+	secretCacheTokenField    = "cache_token"
+	secretRotationPeriod     = "password_rotation_period"
+	secretPasswordRotatedAt  = "password_rotated_at"
+	secretSecretRotatedAt    = "secret_rotated_at"
+	secretPreviousValidUntil = "previous_secret_valid_until"
+	secretClearFieldsField   = "clear_fields"
 
 	secretInternalSiteStoragePath = "siteStoragePath"
 	secretInternalRefreshToken    = "refresh_token"
@@ -31,6 +41,41 @@ type AuthRec struct {
 	Password      string `json:"password"`
 	MaxQPS        int    `json:"qps"`
 	LeaseDuration int    `json:"duration"`
+	EnforceQPS    bool   `json:"enforce_qps"`
+	CacheToken    bool   `json:"cache_token"`
+
+	// Password rotation period, in seconds; zero if the password is not rotated automatically.
+	PasswordRotationPeriod int `json:"password_rotation_period,omitempty"`
+	// Time of the last password change in Epoch seconds.
+	PasswordRotatedAt int64 `json:"password_rotated_at,omitempty"`
+	// New password that was sent to Mashery, but was not yet confirmed to be accepted.
+	PendingPassword string `json:"pending_password,omitempty"`
+
+	// V2 signature settings; empty values select Mashery signature.
+	SigAlgorithm string `json:"sig_algorithm,omitempty"`
+	SigEncoding  string `json:"sig_encoding,omitempty"`
+	SigTimestamp string `json:"sig_timestamp,omitempty"`
+
+	// Time of the last key secret change in Epoch seconds.
+	SecretRotatedAt int64 `json:"secret_rotated_at,omitempty"`
+	// Key secret that was replaced by the last rotation, and the time until which it remains in use.
+	PreviousKeySecret        string `json:"previous_secret,omitempty"`
+	PreviousSecretValidUntil int64  `json:"previous_secret_valid_until,omitempty"`
+	// New key secret that was sent to Mashery, but was not yet confirmed to be accepted.
+	PendingKeySecret string `json:"pending_secret,omitempty"`
+
+	TransportRec
+}
+
+// previousSecretValid whether the key secret replaced by the last rotation is still within the overlap window.
+func (ar AuthRec) previousSecretValid(now time.Time) bool {
+	return len(ar.PreviousKeySecret) > 0 && ar.PreviousSecretValidUntil > now.Unix()
+}
+
+// withPreviousSecret returns a copy of the credentials using the key secret replaced by the last rotation.
+func (ar AuthRec) withPreviousSecret() AuthRec {
+	ar.KeySecret = ar.PreviousKeySecret
+	return ar
 }
 
 func (ar AuthRec) asV3Credentials() v3client.MasheryV3Credentials {
@@ -0,0 +1,500 @@
+package mashery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"yanchuk.nl/hcvault-mashery-api-auth/masherystub"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// End-to-end tests driving the plugin paths against the local Mashery stub.
+
+const (
+	e2eCredentials = "e2e"
+	e2eAreaId      = "7e2e0000-0000-4000-8000-000000000001"
+	e2eAreaNid     = 321
+	e2eApiKey      = "e2ekey"
+	e2eSecret      = "e2esecret"
+	e2eUsername    = "e2euser"
+	e2ePassword    = "e2epassword"
+)
+
+// e2eV3RestPath path of the V3 REST API served by the test, as the stub does not implement it.
+const e2eV3RestPath = "/v3/rest"
+
+type e2eEnv struct {
+	t       *testing.T
+	b       *AuthPlugin
+	storage logical.Storage
+	stub    *masherystub.Stub
+
+	// v3Rest serves the V3 REST API requests; these fail unless the test sets it.
+	v3Rest http.HandlerFunc
+}
+
+// newE2EEnv creates the backend whose mount config points to a fresh stub knowing the e2e package key and user.
+func newE2EEnv(t *testing.T) *e2eEnv {
+	stub := masherystub.New()
+	stub.AddPackageKey(masherystub.PackageKey{ApiKey: e2eApiKey, Secret: e2eSecret, AreaNid: e2eAreaNid})
+	stub.AddUser(masherystub.User{Username: e2eUsername, Password: e2ePassword, AreaId: e2eAreaId})
+
+	// The customized transport replaces the fake OAuth helper with the one reaching the stub.
+	b, s, _ := newTestBackend(t)
+	env := &e2eEnv{t: t, b: b, storage: s, stub: stub}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", stub)
+	mux.HandleFunc(e2eV3RestPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if env.v3Rest == nil {
+			http.NotFound(w, r)
+			return
+		}
+		env.v3Rest(w, r)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	env.mustSucceed(logical.UpdateOperation, "config", map[string]interface{}{
+		transportTokenEndpointField: srv.URL + masherystub.TokenPath,
+		transportV2EndpointField:    srv.URL + masherystub.V2Path,
+		transportV3EndpointField:    srv.URL + e2eV3RestPath,
+	})
+
+	return env
+}
+
+func (env *e2eEnv) request(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+	return handle(env.b, env.storage, op, path, data)
+}
+
+func (env *e2eEnv) mustSucceed(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+	env.t.Helper()
+	return mustHandle(env.t, env.b, env.storage, op, path, data)
+}
+
+func (env *e2eEnv) leaseRequest(op logical.Operation, secret *logical.Secret) (*logical.Response, error) {
+	return env.b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Secret:    secret,
+		Storage:   env.storage,
+	})
+}
+
+func (env *e2eEnv) writeCredentials(data map[string]interface{}) {
+	env.t.Helper()
+
+	creds := map[string]interface{}{
+		secretAreaIdField:    e2eAreaId,
+		secretAreaNidField:   e2eAreaNid,
+		secretApiKeField:     e2eApiKey,
+		secretKeySecretField: e2eSecret,
+		secretUsernameField:  e2eUsername,
+		secretPasswordField:  e2ePassword,
+	}
+	for k, v := range data {
+		creds[k] = v
+	}
+
+	env.mustSucceed(logical.CreateOperation, "credentials/"+e2eCredentials, creds)
+}
+
+func TestE2EWriteCredentialsWithVerification(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(map[string]interface{}{secretVerifyField: true})
+
+	if env.stub.TokenRequests() != 2 {
+		t.Errorf("expected token to be obtained and invalidated, got %d token requests", env.stub.TokenRequests())
+	}
+	if env.stub.V2Requests() != 1 {
+		t.Errorf("expected single V2 ping, got %d V2 requests", env.stub.V2Requests())
+	}
+
+	resp := env.mustSucceed(logical.ReadOperation, "credentials/"+e2eCredentials, nil)
+	if resp.Data[secretAreaIdField] != e2eAreaId {
+		t.Errorf("unexpected area id %v", resp.Data[secretAreaIdField])
+	}
+	if resp.Data[secretV2CapableField] != true || resp.Data[secretV3CapableField] != true {
+		t.Error("verified credentials must be capable of both V2 and V3")
+	}
+	if resp.Data[secretApiKeField] == e2eApiKey {
+		t.Error("api key must be masked")
+	}
+}
+
+func TestE2EWriteCredentialsRejectedByMashery(t *testing.T) {
+	env := newE2EEnv(t)
+
+	resp, err := env.request(logical.CreateOperation, "credentials/"+e2eCredentials, map[string]interface{}{
+		secretAreaIdField:    e2eAreaId,
+		secretApiKeField:     e2eApiKey,
+		secretKeySecretField: e2eSecret,
+		secretUsernameField:  e2eUsername,
+		secretPasswordField:  "wrong",
+		secretVerifyField:    true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !resp.IsError() {
+		t.Fatal("credentials with wrong password must fail verification")
+	}
+
+	if v3Rec, err := getAuthRecordByName(context.Background(), env.storage, e2eCredentials); err != nil {
+		t.Fatal(err)
+	} else if v3Rec != nil {
+		t.Error("credentials that failed verification must not be saved")
+	}
+}
+
+func TestE2EV3AccessTokenIssuedAndRevoked(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	resp := env.mustSucceed(logical.ReadOperation, "auth/"+e2eCredentials+"/v3", nil)
+	accessToken := resp.Data[secretAccessToken].(string)
+	if !env.stub.AccessTokenValid(accessToken) {
+		t.Fatal("issued access token is not known to Mashery")
+	}
+	if resp.Secret.TTL != time.Second*defaultLeaseDuration {
+		t.Errorf("unexpected lease TTL %s", resp.Secret.TTL)
+	}
+
+	if _, err := env.leaseRequest(logical.RevokeOperation, persistedLease(t, resp)); err != nil {
+		t.Fatalf("revocation failed: %s", err)
+	}
+	if env.stub.AccessTokenValid(accessToken) {
+		t.Error("revoked access token must be invalidated")
+	}
+}
+
+func TestE2EV3RenewalRefreshesExpiringToken(t *testing.T) {
+	env := newE2EEnv(t)
+	env.stub.SetTokenLife(time.Second * v3RefreshAheadTime)
+	env.writeCredentials(nil)
+
+	resp := env.mustSucceed(logical.ReadOperation, "auth/"+e2eCredentials+"/v3", nil)
+	accessToken := resp.Data[secretAccessToken].(string)
+	if resp.Secret.TTL != time.Second*v3RefreshAheadTime {
+		t.Errorf("lease must not outlive the access token, got TTL %s", resp.Secret.TTL)
+	}
+
+	renewed, err := env.leaseRequest(logical.RenewOperation, persistedLease(t, resp))
+	if err != nil {
+		t.Fatalf("renewal failed: %s", err)
+	}
+
+	renewedToken, _ := renewed.Data[secretAccessToken].(string)
+	if len(renewedToken) == 0 || renewedToken == accessToken {
+		t.Fatal("renewal of the expiring lease must return a new access token")
+	}
+	if env.stub.AccessTokenValid(accessToken) || !env.stub.AccessTokenValid(renewedToken) {
+		t.Error("refreshed access token must replace the original one")
+	}
+}
+
+func TestE2EV3TokenEndpointThrottlingIsRetried(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(map[string]interface{}{
+		transportMaxRetriesField: 1,
+		transportRetryWaitField:  1,
+	})
+
+	env.stub.Throttle(1)
+	resp := env.mustSucceed(logical.ReadOperation, "auth/"+e2eCredentials+"/v3", nil)
+	if !env.stub.AccessTokenValid(resp.Data[secretAccessToken].(string)) {
+		t.Error("access token obtained on retry is not known to Mashery")
+	}
+	if env.stub.TokenRequests() != 2 {
+		t.Errorf("expected throttled request to be retried once, got %d token requests", env.stub.TokenRequests())
+	}
+
+	env.stub.Throttle(2)
+	if _, err := env.request(logical.ReadOperation, "auth/"+e2eCredentials+"/v3", nil); err == nil {
+		t.Error("access token must not be issued when throttling outlasts the retries")
+	}
+}
+
+func TestE2EV3TokenRefusedAfterSecretChange(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	env.stub.AddPackageKey(masherystub.PackageKey{ApiKey: e2eApiKey, Secret: "changed", AreaNid: e2eAreaNid})
+	if _, err := env.request(logical.ReadOperation, "auth/"+e2eCredentials+"/v3", nil); err == nil {
+		t.Error("access token must not be issued with outdated secret")
+	}
+}
+
+func TestE2EV2SignatureAcceptedByMashery(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	resp := env.mustSucceed(logical.ReadOperation, "auth/"+e2eCredentials+"/v2", map[string]interface{}{
+		secretIncludeUrlField: true,
+	})
+
+	ts := time.Unix(resp.Data[secretV2TimestampField].(int64), 0)
+	if resp.Data[secretSignedSecretField] != masherystub.Sign(e2eApiKey, e2eSecret, ts) {
+		t.Error("signature does not match Mashery signature of the returned timestamp")
+	}
+
+	httpResp, err := http.Post(resp.Data[secretV2UrlField].(string), "application/json", strings.NewReader(v2PingRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Errorf("Mashery rejected the signed request with status %d", httpResp.StatusCode)
+	}
+}
+
+func TestE2EV2SignatureCalibratedForClockSkew(t *testing.T) {
+	env := newE2EEnv(t)
+	env.stub.SetClockSkew(20 * time.Minute)
+	env.writeCredentials(nil)
+
+	resp, err := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/verify", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if resp.Data[secretV2VerifiedField] != false {
+		t.Fatal("signature salted with the skewed time must be rejected")
+	}
+
+	env.mustSucceed(logical.UpdateOperation, "config", map[string]interface{}{
+		configV2CalibrateTimeField: true,
+	})
+
+	resp = env.mustSucceed(logical.UpdateOperation, "credentials/"+e2eCredentials+"/verify", nil)
+	if resp.Data[secretV2VerifiedField] != true {
+		t.Errorf("calibrated signature must be accepted: %v", resp.Data[secretVerifyErrorsField])
+	}
+}
+
+// serveMemberPasswordChange serves the V3 REST API finding the e2e user and changing its password. The change is
+// applied in the stub if apply is set, and is answered with the specified status code.
+func (env *e2eEnv) serveMemberPasswordChange(apply bool, status int) {
+	env.v3Rest = func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode([]v3Member{{Id: "member-1", Username: e2eUsername}})
+		case http.MethodPut:
+			change := map[string]string{}
+			_ = json.NewDecoder(r.Body).Decode(&change)
+			if apply {
+				env.stub.AddUser(masherystub.User{Username: e2eUsername, Password: change["passwdNew"], AreaId: e2eAreaId})
+			}
+			w.WriteHeader(status)
+		}
+	}
+}
+
+func (env *e2eEnv) storedCredentials() *AuthRec {
+	env.t.Helper()
+
+	v3Rec, err := getAuthRecordByName(context.Background(), env.storage, e2eCredentials)
+	if err != nil || v3Rec == nil {
+		env.t.Fatalf("cannot read stored credentials: %v", err)
+	}
+	return v3Rec
+}
+
+func TestE2EPasswordChangeWithLostResponseIsConfirmedOnNextRotation(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	env.serveMemberPasswordChange(true, http.StatusBadGateway)
+	if resp, _ := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-password", nil); !resp.IsError() {
+		t.Fatal("rotation must fail when Mashery does not confirm the change")
+	}
+
+	pending := env.storedCredentials().PendingPassword
+	if len(pending) == 0 {
+		t.Fatal("pending password must be kept when the outcome of the change is unknown")
+	}
+
+	env.v3Rest = nil
+	env.mustSucceed(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-password", nil)
+
+	if v3Rec := env.storedCredentials(); v3Rec.Password != pending || len(v3Rec.PendingPassword) > 0 {
+		t.Error("pending password accepted by Mashery must replace the stored password")
+	}
+}
+
+func TestE2ERollbackIsRefusedWhileRotationIsPending(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+	env.writeCredentials(map[string]interface{}{secretQpsField: 5})
+
+	env.serveMemberPasswordChange(true, http.StatusBadGateway)
+	if resp, _ := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-password", nil); !resp.IsError() {
+		t.Fatal("rotation must fail when Mashery does not confirm the change")
+	}
+
+	if resp, _ := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rollback", map[string]interface{}{versionField: 1}); !resp.IsError() {
+		t.Fatal("rollback must be refused while the password rotation is pending")
+	}
+	if len(env.storedCredentials().PendingPassword) == 0 {
+		t.Fatal("refused rollback must keep the pending password")
+	}
+
+	env.v3Rest = nil
+	env.mustSucceed(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-password", nil)
+	env.mustSucceed(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rollback", map[string]interface{}{versionField: 1})
+}
+
+func TestE2EPasswordChangeNotAppliedIsDiscardedOnNextRotation(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	env.serveMemberPasswordChange(false, http.StatusBadGateway)
+	if resp, _ := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-password", nil); !resp.IsError() {
+		t.Fatal("rotation must fail when Mashery does not confirm the change")
+	}
+	lost := env.storedCredentials().PendingPassword
+
+	env.serveMemberPasswordChange(true, http.StatusOK)
+	env.mustSucceed(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-password", nil)
+
+	if v3Rec := env.storedCredentials(); v3Rec.Password == e2ePassword || v3Rec.Password == lost || len(v3Rec.PendingPassword) > 0 {
+		t.Error("password must be rotated to a new password once the pending one was found not applied")
+	}
+}
+
+func TestE2EPasswordChangeRejectedByMasheryIsDiscarded(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	env.serveMemberPasswordChange(false, http.StatusBadRequest)
+	if resp, _ := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-password", nil); !resp.IsError() {
+		t.Fatal("rotation must fail when Mashery rejects the change")
+	}
+
+	if v3Rec := env.storedCredentials(); v3Rec.Password != e2ePassword || len(v3Rec.PendingPassword) > 0 {
+		t.Error("password rejected by Mashery must be discarded")
+	}
+}
+
+func TestE2EScheduledPasswordRotationBacksOffAfterFailure(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(map[string]interface{}{secretRotationPeriod: "720h"})
+
+	v3Rec := env.storedCredentials()
+	v3Rec.PasswordRotatedAt = time.Now().Add(-721 * time.Hour).Unix()
+	if err := putAuthRecordByName(context.Background(), env.storage, e2eCredentials, v3Rec); err != nil {
+		t.Fatalf("cannot store credentials: %s", err)
+	}
+
+	periodicReq := &logical.Request{Storage: env.storage}
+	if err := env.b.rotateDuePasswords(context.Background(), periodicReq); err == nil {
+		t.Fatal("failed scheduled rotation must be reported")
+	}
+
+	attempted := env.stub.TokenRequests()
+	if err := env.b.rotateDuePasswords(context.Background(), periodicReq); err != nil {
+		t.Fatalf("rotation must not be retried before the retry delay, got %s", err)
+	}
+	if env.stub.TokenRequests() != attempted {
+		t.Error("rotation must not be retried before the retry delay")
+	}
+
+	attempt := env.b.rotationAttempts[e2eCredentials]
+	if attempt.failures != 1 || !attempt.retryAt().Equal(attempt.at.Add(passwordRotationRetryDelay)) {
+		t.Errorf("unexpected failed rotation attempt %+v", attempt)
+	}
+	attempt.at = attempt.at.Add(-passwordRotationRetryDelay)
+	env.b.rotationAttempts[e2eCredentials] = attempt
+
+	env.serveMemberPasswordChange(true, http.StatusOK)
+	if err := env.b.rotateDuePasswords(context.Background(), periodicReq); err != nil {
+		t.Fatalf("rotation must be retried after the retry delay, got %s", err)
+	}
+	if env.storedCredentials().Password == e2ePassword {
+		t.Error("password must be rotated on retry")
+	}
+	if _, ok := env.b.rotationAttempts[e2eCredentials]; ok {
+		t.Error("successful rotation must clear the failed attempt")
+	}
+}
+
+// servePackageKeySecretChange serves the V3 REST API reading the e2e package key and changing its secret. The
+// change is applied in the stub if apply is set, and is answered with the specified status code.
+func (env *e2eEnv) servePackageKeySecretChange(apply bool, status int) {
+	secret := env.storedCredentials().KeySecret
+	env.v3Rest = func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode([]v3PackageKey{{Id: "key-1", Apikey: e2eApiKey, Secret: secret}})
+		case http.MethodPut:
+			change := v3PackageKey{}
+			_ = json.NewDecoder(r.Body).Decode(&change)
+			if apply {
+				secret = change.Secret
+				env.stub.AddPackageKey(masherystub.PackageKey{ApiKey: e2eApiKey, Secret: secret, AreaNid: e2eAreaNid})
+			}
+			w.WriteHeader(status)
+		}
+	}
+}
+
+func TestE2ESecretChangeWithLostResponseIsConfirmedOnNextRotation(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	env.servePackageKeySecretChange(true, http.StatusGatewayTimeout)
+	if resp, _ := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-secret", nil); !resp.IsError() {
+		t.Fatal("rotation must fail when Mashery does not confirm the change")
+	}
+
+	pending := env.storedCredentials().PendingKeySecret
+	if len(pending) == 0 {
+		t.Fatal("pending secret must be kept when the outcome of the change is unknown")
+	}
+
+	// The stored secret is no longer accepted; the secret is read with the access token granted for the pending one.
+	env.mustSucceed(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-secret", nil)
+
+	v3Rec := env.storedCredentials()
+	if v3Rec.KeySecret != pending || v3Rec.PreviousKeySecret != e2eSecret || len(v3Rec.PendingKeySecret) > 0 {
+		t.Error("pending secret applied by Mashery must replace the stored secret")
+	}
+}
+
+func TestE2ESecretChangeNotAppliedIsDiscardedOnNextRotation(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	env.servePackageKeySecretChange(false, http.StatusBadGateway)
+	if resp, _ := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-secret", nil); !resp.IsError() {
+		t.Fatal("rotation must fail when Mashery does not confirm the change")
+	}
+	lost := env.storedCredentials().PendingKeySecret
+
+	env.servePackageKeySecretChange(true, http.StatusOK)
+	env.mustSucceed(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-secret", nil)
+
+	v3Rec := env.storedCredentials()
+	if v3Rec.KeySecret == e2eSecret || v3Rec.KeySecret == lost || v3Rec.PreviousKeySecret != e2eSecret {
+		t.Error("secret must be rotated to a new secret once the pending one was found not applied")
+	}
+}
+
+func TestE2ESecretChangeRejectedByMasheryIsDiscarded(t *testing.T) {
+	env := newE2EEnv(t)
+	env.writeCredentials(nil)
+
+	env.servePackageKeySecretChange(false, http.StatusForbidden)
+	if resp, _ := env.request(logical.UpdateOperation, "credentials/"+e2eCredentials+"/rotate-secret", nil); !resp.IsError() {
+		t.Fatal("rotation must fail when Mashery rejects the change")
+	}
+
+	if v3Rec := env.storedCredentials(); v3Rec.KeySecret != e2eSecret || len(v3Rec.PendingKeySecret) > 0 {
+		t.Error("secret rejected by Mashery must be discarded")
+	}
+}
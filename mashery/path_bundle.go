@@ -0,0 +1,450 @@
+package mashery
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Credentials bundle carries the stored credentials between mounts or Vault clusters. The credentials are encrypted
+// with a random AES-256-GCM key; the key is either encrypted with the caller's RSA public key (RSA-OAEP with
+// SHA-256), or is the caller-supplied symmetric key itself.
+
+const (
+	bundleNamesField          = "names"
+	bundlePublicKeyField      = "public_key"
+	bundlePrivateKeyField     = "private_key"
+	bundleKeyField            = "key"
+	bundleField               = "bundle"
+	bundleConflictPolicyField = "conflict_policy"
+
+	bundleImportedField    = "imported"
+	bundleOverwrittenField = "overwritten"
+	bundleSkippedField     = "skipped"
+	bundleUnchangedField   = "unchanged"
+
+	conflictPolicySkip      = "skip"
+	conflictPolicyOverwrite = "overwrite"
+	conflictPolicyFail      = "fail"
+
+	bundleFormatVersion = 1
+
+	versionOpImport = "import"
+
+	pathCredentialsExportHelpSyn  = "Exports stored Mashery credentials as an encrypted bundle"
+	pathCredentialsExportHelpDesc = `
+Serializes the selected credentials (all credentials if no names are given) into a bundle encrypted either with
+the supplied PEM-encoded RSA public key, or with the supplied base64-encoded 256-bit symmetric key. The bundle
+can be imported into another mount with credentials-import, supplying the matching private key or the same
+symmetric key.`
+
+	pathCredentialsImportHelpSyn  = "Imports Mashery credentials from an encrypted bundle"
+	pathCredentialsImportHelpDesc = `
+Decrypts the bundle created by credentials-export and stores the credentials it contains. Credentials that are
+identical to the already stored ones are left unchanged, so that the import can be safely repeated. The conflict
+policy defines what happens when different credentials are already stored under the same name:
+- skip: the stored credentials are kept;
+- overwrite: the stored credentials are replaced; the replaced version is retained in the history;
+- fail (default): nothing is imported.`
+)
+
+type credentialsBundle struct {
+	Version      int    `json:"version"`
+	EncryptedKey string `json:"encrypted_key,omitempty"`
+	Nonce        string `json:"nonce"`
+	Ciphertext   string `json:"ciphertext"`
+}
+
+type credentialsBundlePayload struct {
+	ExportedTime int64              `json:"exported_time"`
+	Credentials  map[string]AuthRec `json:"credentials"`
+}
+
+func pathCredentialsExport(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials-export",
+		Fields: map[string]*framework.FieldSchema{
+			bundleNamesField: {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Logical names of the credentials to export; all credentials if omitted",
+				DisplayName: "Credentials names",
+			},
+			bundlePublicKeyField: {
+				Type:        framework.TypeString,
+				Description: "PEM-encoded RSA public key to encrypt the bundle with",
+				DisplayName: "Public key",
+			},
+			bundleKeyField: {
+				Type:             framework.TypeString,
+				Description:      "Base64-encoded 256-bit symmetric key to encrypt the bundle with",
+				DisplayName:      "Symmetric key",
+				DisplaySensitive: true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleExportCredentials,
+				Summary:  "Export credentials as an encrypted bundle",
+			},
+		},
+		HelpSynopsis:    pathCredentialsExportHelpSyn,
+		HelpDescription: pathCredentialsExportHelpDesc,
+	}
+}
+
+func pathCredentialsImport(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials-import",
+		Fields: map[string]*framework.FieldSchema{
+			bundleField: {
+				Type:        framework.TypeString,
+				Description: "Bundle returned by credentials-export",
+				DisplayName: "Bundle",
+				Required:    true,
+			},
+			bundlePrivateKeyField: {
+				Type:             framework.TypeString,
+				Description:      "PEM-encoded RSA private key matching the public key the bundle was encrypted with",
+				DisplayName:      "Private key",
+				DisplaySensitive: true,
+			},
+			bundleKeyField: {
+				Type:             framework.TypeString,
+				Description:      "Base64-encoded 256-bit symmetric key the bundle was encrypted with",
+				DisplayName:      "Symmetric key",
+				DisplaySensitive: true,
+			},
+			bundleConflictPolicyField: {
+				Type:        framework.TypeString,
+				Description: "What to do when different credentials are stored under the same name: skip, overwrite, or fail",
+				DisplayName: "Conflict policy",
+				Default:     conflictPolicyFail,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleImportCredentials,
+				Summary:  "Import credentials from an encrypted bundle",
+			},
+		},
+		HelpSynopsis:    pathCredentialsImportHelpSyn,
+		HelpDescription: pathCredentialsImportHelpDesc,
+	}
+}
+
+func decodeSymmetricKey(raw string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errwrap.Wrapf("key is not base64-encoded: {{err}}", err)
+	} else if len(key) != 32 {
+		return nil, errors.New("key must be 256 bits long")
+	}
+	return key, nil
+}
+
+func parsePemBlock(raw string, field string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(raw))
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM-encoded", field)
+	}
+	return block.Bytes, nil
+}
+
+func parseRSAPublicKey(raw string) (*rsa.PublicKey, error) {
+	der, err := parsePemBlock(raw, bundlePublicKeyField)
+	if err != nil {
+		return nil, err
+	}
+
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if rsaPub, ok := pub.(*rsa.PublicKey); ok {
+			return rsaPub, nil
+		}
+		return nil, errors.New("public_key is not an RSA key")
+	}
+	return x509.ParsePKCS1PublicKey(der)
+}
+
+func parseRSAPrivateKey(raw string) (*rsa.PrivateKey, error) {
+	der, err := parsePemBlock(raw, bundlePrivateKeyField)
+	if err != nil {
+		return nil, err
+	}
+
+	if priv, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if rsaPriv, ok := priv.(*rsa.PrivateKey); ok {
+			return rsaPriv, nil
+		}
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// sealBundle encrypts the payload. Exactly one of the public key and the symmetric key must be supplied.
+func sealBundle(payload []byte, pub *rsa.PublicKey, symmetricKey []byte) (*credentialsBundle, error) {
+	retVal := credentialsBundle{Version: bundleFormatVersion}
+
+	dataKey := symmetricKey
+	if pub != nil {
+		dataKey = make([]byte, 32)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+
+		if encKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, dataKey, nil); err != nil {
+			return nil, errwrap.Wrapf("cannot encrypt bundle key: {{err}}", err)
+		} else {
+			retVal.EncryptedKey = base64.StdEncoding.EncodeToString(encKey)
+		}
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	retVal.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	retVal.Ciphertext = base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, payload, nil))
+	return &retVal, nil
+}
+
+func openBundle(bundle *credentialsBundle, priv *rsa.PrivateKey, symmetricKey []byte) ([]byte, error) {
+	if bundle.Version != bundleFormatVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+
+	dataKey := symmetricKey
+	if len(bundle.EncryptedKey) > 0 {
+		if priv == nil {
+			return nil, errors.New("bundle was encrypted with a public key; private_key is required")
+		}
+
+		encKey, err := base64.StdEncoding.DecodeString(bundle.EncryptedKey)
+		if err != nil {
+			return nil, errwrap.Wrapf("malformed bundle key: {{err}}", err)
+		}
+		if dataKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, encKey, nil); err != nil {
+			return nil, errors.New("bundle key cannot be decrypted with this private key")
+		}
+	} else if dataKey == nil {
+		return nil, errors.New("bundle was encrypted with a symmetric key; key is required")
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(bundle.Nonce)
+	if err != nil {
+		return nil, errwrap.Wrapf("malformed bundle nonce: {{err}}", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(bundle.Ciphertext)
+	if err != nil {
+		return nil, errwrap.Wrapf("malformed bundle ciphertext: {{err}}", err)
+	}
+
+	if plaintext, err := gcm.Open(nil, nonce, ciphertext, nil); err != nil {
+		return nil, errors.New("bundle cannot be decrypted with this key")
+	} else {
+		return plaintext, nil
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (b *AuthPlugin) handleExportCredentials(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	var pub *rsa.PublicKey
+	var symmetricKey []byte
+	var err error
+
+	pubRaw, hasPub := data.GetOk(bundlePublicKeyField)
+	keyRaw, hasKey := data.GetOk(bundleKeyField)
+	if hasPub == hasKey {
+		return logical.ErrorResponse("exactly one of public_key and key must be specified"), nil
+	} else if hasPub {
+		if pub, err = parseRSAPublicKey(pubRaw.(string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	} else if symmetricKey, err = decodeSymmetricKey(keyRaw.(string)); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	names := data.Get(bundleNamesField).([]string)
+	for _, name := range names {
+		if !validCredentialsName.MatchString(name) {
+			return logical.ErrorResponse("'%s' is not a valid credentials name", name), nil
+		}
+	}
+	if len(names) == 0 {
+		if names, err = req.Storage.List(ctx, areaStoragePrefix); err != nil {
+			return nil, errwrap.Wrapf("failed to list site data: {{err}}", err)
+		}
+	}
+	sort.Strings(names)
+
+	payload := credentialsBundlePayload{
+		ExportedTime: time.Now().Unix(),
+		Credentials:  map[string]AuthRec{},
+	}
+	for _, name := range names {
+		if v3Rec, err := getAuthRecordByName(ctx, req.Storage, name); err != nil {
+			return nil, err
+		} else if v3Rec == nil {
+			return logical.ErrorResponse("credentials '%s' are not stored", name), nil
+		} else {
+			v3Rec.PendingPassword = ""
+			v3Rec.PendingKeySecret = ""
+			payload.Credentials[name] = *v3Rec
+		}
+	}
+
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errwrap.Wrapf("cannot marshal credentials: {{err}}", err)
+	}
+
+	bundle, err := sealBundle(plaintext, pub, symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, errwrap.Wrapf("cannot marshal bundle: {{err}}", err)
+	}
+
+	b.Logger().Info("Exported credentials", "count", len(names), "requester", req.DisplayName)
+	return &logical.Response{
+		Data: map[string]interface{}{
+			bundleField:      base64.StdEncoding.EncodeToString(bundleJSON),
+			bundleNamesField: names,
+		},
+	}, nil
+}
+
+func (b *AuthPlugin) handleImportCredentials(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	policy := data.Get(bundleConflictPolicyField).(string)
+	if policy != conflictPolicySkip && policy != conflictPolicyOverwrite && policy != conflictPolicyFail {
+		return logical.ErrorResponse("unsupported conflict policy '%s'", policy), nil
+	}
+
+	var priv *rsa.PrivateKey
+	var symmetricKey []byte
+	var err error
+
+	if privRaw, ok := data.GetOk(bundlePrivateKeyField); ok {
+		if priv, err = parseRSAPrivateKey(privRaw.(string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	if keyRaw, ok := data.GetOk(bundleKeyField); ok {
+		if symmetricKey, err = decodeSymmetricKey(keyRaw.(string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	bundle := credentialsBundle{}
+	if bundleJSON, err := base64.StdEncoding.DecodeString(data.Get(bundleField).(string)); err != nil {
+		return logical.ErrorResponse("bundle is not base64-encoded"), nil
+	} else if err = json.Unmarshal(bundleJSON, &bundle); err != nil {
+		return logical.ErrorResponse("bundle is malformed"), nil
+	}
+
+	plaintext, err := openBundle(&bundle, priv, symmetricKey)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	payload := credentialsBundlePayload{}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return logical.ErrorResponse("bundle payload is malformed"), nil
+	}
+
+	names := make([]string, 0, len(payload.Credentials))
+	for name := range payload.Credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !validCredentialsName.MatchString(name) {
+			return logical.ErrorResponse("'%s' in the bundle is not a valid credentials name; nothing was imported", name), nil
+		}
+	}
+
+	b.credsLock.Lock()
+	defer b.credsLock.Unlock()
+
+	var imported, overwritten, skipped, unchanged []string
+
+	// All conflicts are resolved before anything is written, so that the fail policy leaves the mount untouched.
+	for _, name := range names {
+		importedRec := payload.Credentials[name]
+		if fe := validateAuthRec(&importedRec); len(fe) > 0 {
+			resp := fe.asResponse()
+			resp.Data["error"] = fmt.Sprintf("credentials '%s' in the bundle are invalid; nothing was imported", name)
+			return resp, nil
+		}
+
+		if storedRec, err := getAuthRecordByName(ctx, req.Storage, name); err != nil {
+			return nil, err
+		} else if storedRec == nil {
+			imported = append(imported, name)
+		} else if reflect.DeepEqual(*storedRec, importedRec) {
+			unchanged = append(unchanged, name)
+		} else if policy == conflictPolicyFail {
+			return logical.ErrorResponse("different credentials '%s' are already stored; nothing was imported", name), nil
+		} else if policy == conflictPolicySkip {
+			skipped = append(skipped, name)
+		} else {
+			overwritten = append(overwritten, name)
+		}
+	}
+
+	for _, name := range append(append([]string{}, imported...), overwritten...) {
+		importedRec := payload.Credentials[name]
+		if err := putAuthRecordVersion(ctx, req.Storage, name, &importedRec, req.DisplayName, req.EntityID, versionOpImport); err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("failed to import credentials '%s': {{err}}", name), err)
+		}
+	}
+
+	b.Logger().Info("Imported credentials", "imported", len(imported), "overwritten", len(overwritten),
+		"skipped", len(skipped), "unchanged", len(unchanged), "requester", req.DisplayName)
+	return &logical.Response{
+		Data: map[string]interface{}{
+			bundleImportedField:    imported,
+			bundleOverwrittenField: overwritten,
+			bundleSkippedField:     skipped,
+			bundleUnchangedField:   unchanged,
+		},
+	}, nil
+}
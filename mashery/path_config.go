@@ -0,0 +1,298 @@
+package mashery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const (
+	configStoragePath = "config"
+
+	configDefaultQpsField           = "default_qps"
+	configDefaultLeaseDurationField = "default_lease_duration"
+	configMaxLeaseDurationField     = "max_lease_duration"
+	configMaxTTLField               = "max_ttl"
+	configV2LeaseDurationField      = "v2_lease_duration"
+	configV2ClockOffsetField        = "v2_clock_offset"
+	configV2CalibrateTimeField      = "v2_calibrate_time"
+
+	defaultQPS           = 2
+	defaultLeaseDuration = 15 * 60
+	// Mashery V3 access tokens are valid for 1 hour.
+	maxV3TokenLife = 60 * 60
+	// V3 leases renewed by refreshing the token last a day unless the mount or the role specify otherwise.
+	defaultV3MaxTTL = 24 * 60 * 60
+	// Clock offset beyond an hour indicates misconfiguration rather than a clock skew.
+	maxV2ClockOffset = 60 * 60
+
+	pathConfigHelpSyn  = "Configures mount-wide settings"
+	pathConfigHelpDesc = `
+Configures the settings that apply to all credentials stored in this mount, unless the credentials override them.
+The settings include the defaults for the credentials that omit QPS and V3 lease duration, the maximum V3 lease
+duration, the maximum time V3 leases can be renewed for, the lease duration of V2 signatures, and Mashery API versions the mount issues credentials for.
+The time V2 signatures are salted with can be corrected for the clock skew between Vault and Mashery either by
+a fixed offset, or by calibrating it against the time of Mashery V2 endpoint.
+The settings also include Mashery token endpoint, V2 and V3 API base URLs, and HTTP transport (proxy, additional CA
+certificates, client timeout, and retry policy). These allow reaching Mashery private-cloud or on-premises
+deployments, test stubs, or reaching Mashery via an egress proxy.`
+)
+
+// MountConfig mount-wide settings.
+type MountConfig struct {
+	DefaultQPS           int      `json:"default_qps,omitempty"`
+	DefaultLeaseDuration int      `json:"default_lease_duration,omitempty"`
+	MaxLeaseDuration     int      `json:"max_lease_duration,omitempty"`
+	MaxTTL               int      `json:"max_ttl,omitempty"`
+	V2LeaseDuration      int      `json:"v2_lease_duration,omitempty"`
+	AllowedVersions      []string `json:"allowed_api_versions,omitempty"`
+	V2ClockOffset        int      `json:"v2_clock_offset,omitempty"`
+	V2CalibrateTime      bool     `json:"v2_calibrate_time,omitempty"`
+
+	TransportRec
+}
+
+func (cfg *MountConfig) allows(apiVersion string) bool {
+	if len(cfg.AllowedVersions) == 0 {
+		return true
+	}
+
+	for _, v := range cfg.AllowedVersions {
+		if v == apiVersion {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *MountConfig) maxLeaseDuration() int {
+	if cfg.MaxLeaseDuration > 0 {
+		return cfg.MaxLeaseDuration
+	}
+	return maxV3TokenLife
+}
+
+// v3MaxTTL maximum duration of the V3 lease, counting the renewals.
+func (cfg *MountConfig) v3MaxTTL() time.Duration {
+	if cfg.MaxTTL > 0 {
+		return time.Second * time.Duration(cfg.MaxTTL)
+	}
+	return time.Second * defaultV3MaxTTL
+}
+
+func (cfg *MountConfig) v2LeaseDuration() time.Duration {
+	if cfg.V2LeaseDuration > 0 {
+		return time.Second * time.Duration(cfg.V2LeaseDuration)
+	}
+	return v2SignatureLease
+}
+
+// applyDefaultsTo fills QPS and lease duration the credentials omit with the mount-wide defaults, and caps the lease
+// duration at the mount-wide maximum.
+func (cfg *MountConfig) applyDefaultsTo(v3Rec AuthRec) AuthRec {
+	if v3Rec.MaxQPS == 0 {
+		v3Rec.MaxQPS = defaultQPS
+		if cfg.DefaultQPS > 0 {
+			v3Rec.MaxQPS = cfg.DefaultQPS
+		}
+	}
+
+	if v3Rec.LeaseDuration == 0 {
+		v3Rec.LeaseDuration = defaultLeaseDuration
+		if cfg.DefaultLeaseDuration > 0 {
+			v3Rec.LeaseDuration = cfg.DefaultLeaseDuration
+		}
+	}
+	v3Rec.LeaseDuration = min(v3Rec.LeaseDuration, cfg.maxLeaseDuration())
+
+	return v3Rec
+}
+
+// withMountDefaults returns a copy of the credentials with the mount-wide defaults applied.
+func (b *AuthPlugin) withMountDefaults(ctx context.Context, s logical.Storage, v3Rec *AuthRec) (*AuthRec, error) {
+	if v3Rec == nil {
+		return nil, nil
+	}
+
+	if cfg, err := getMountConfig(ctx, s); err != nil {
+		return nil, err
+	} else {
+		retVal := cfg.applyDefaultsTo(*v3Rec)
+		return &retVal, nil
+	}
+}
+
+func pathConfig(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "config",
+		Fields: transportFieldSchemas(map[string]*framework.FieldSchema{
+			configDefaultQpsField: {
+				Type:        framework.TypeInt,
+				Description: fmt.Sprintf("QPS of the credentials that do not specify it. Defaults to %d", defaultQPS),
+				DisplayName: "Default QPS",
+			},
+			configDefaultLeaseDurationField: {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("V3 lease duration of the credentials that do not specify it. Defaults to %d seconds", defaultLeaseDuration),
+				DisplayName: "Default V3 lease duration",
+			},
+			configMaxLeaseDurationField: {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("Maximum V3 lease duration. Defaults to %d seconds", maxV3TokenLife),
+				DisplayName: "Maximum V3 lease duration",
+			},
+			configMaxTTLField: {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("Maximum duration of V3 leases issued without a role, counting the renewals. Defaults to %d seconds", defaultV3MaxTTL),
+				DisplayName: "Maximum V3 lease TTL",
+			},
+			configV2LeaseDurationField: {
+				Type:        framework.TypeDurationSecond,
+				Description: "Lease duration of V2 signatures. Defaults to 60 seconds",
+				DisplayName: "V2 lease duration",
+			},
+			configV2ClockOffsetField: {
+				Type:        framework.TypeInt,
+				Description: "Seconds added to Vault time when salting V2 signatures; may be negative",
+				DisplayName: "V2 clock offset",
+			},
+			configV2CalibrateTimeField: {
+				Type:        framework.TypeBool,
+				Description: "Calibrate V2 signing time against the Date header of Mashery V2 endpoint; overrides v2_clock_offset when successful",
+				DisplayName: "Calibrate V2 signing time",
+			},
+			roleAllowedVersion: {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Mashery API versions (v2, v3) this mount issues credentials for. Defaults to both",
+				DisplayName: "Allowed API versions",
+			},
+		}),
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleReadConfig,
+				Summary:  "Read mount-wide settings",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleWriteConfig,
+				Summary:  "Update mount-wide settings",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.handleDeleteConfig,
+				Summary:  "Reset mount-wide settings to defaults",
+			},
+		},
+		HelpSynopsis:    pathConfigHelpSyn,
+		HelpDescription: pathConfigHelpDesc,
+	}
+}
+
+func getMountConfig(ctx context.Context, s logical.Storage) (*MountConfig, error) {
+	retVal := MountConfig{}
+
+	if entry, err := s.Get(ctx, configStoragePath); err != nil {
+		return nil, err
+	} else if entry != nil {
+		if err := entry.DecodeJSON(&retVal); err != nil {
+			return nil, errwrap.Wrapf("cannot unmarshal mount configuration ({{err}})", err)
+		}
+	}
+
+	return &retVal, nil
+}
+
+func (b *AuthPlugin) handleReadConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if cfg, err := getMountConfig(ctx, req.Storage); err != nil {
+		return nil, err
+	} else {
+		return &logical.Response{
+			Data: transportResponseData(cfg.TransportRec, map[string]interface{}{
+				configDefaultQpsField:           cfg.DefaultQPS,
+				configDefaultLeaseDurationField: cfg.DefaultLeaseDuration,
+				configMaxLeaseDurationField:     cfg.MaxLeaseDuration,
+				configMaxTTLField:               cfg.MaxTTL,
+				configV2LeaseDurationField:      cfg.V2LeaseDuration,
+				configV2ClockOffsetField:        cfg.V2ClockOffset,
+				configV2CalibrateTimeField:      cfg.V2CalibrateTime,
+				roleAllowedVersion:              cfg.AllowedVersions,
+			}),
+		}, nil
+	}
+}
+
+func (b *AuthPlugin) handleWriteConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw, ok := data.GetOk(configDefaultQpsField); ok {
+		cfg.DefaultQPS = raw.(int)
+	}
+	if raw, ok := data.GetOk(configDefaultLeaseDurationField); ok {
+		cfg.DefaultLeaseDuration = raw.(int)
+	}
+	if raw, ok := data.GetOk(configMaxLeaseDurationField); ok {
+		cfg.MaxLeaseDuration = raw.(int)
+	}
+	if raw, ok := data.GetOk(configMaxTTLField); ok {
+		cfg.MaxTTL = raw.(int)
+	}
+	if raw, ok := data.GetOk(configV2LeaseDurationField); ok {
+		cfg.V2LeaseDuration = raw.(int)
+	}
+	if raw, ok := data.GetOk(roleAllowedVersion); ok {
+		cfg.AllowedVersions = raw.([]string)
+	}
+	if raw, ok := data.GetOk(configV2ClockOffsetField); ok {
+		cfg.V2ClockOffset = raw.(int)
+	}
+	if raw, ok := data.GetOk(configV2CalibrateTimeField); ok {
+		cfg.V2CalibrateTime = raw.(bool)
+	}
+	mergeTransportFieldsInto(data, &cfg.TransportRec)
+
+	if err := validateMountConfig(cfg); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if se, err := logical.StorageEntryJSON(configStoragePath, cfg); err != nil {
+		return nil, errwrap.Wrapf("failed to save mount configuration: {{err}}", err)
+	} else {
+		return nil, req.Storage.Put(ctx, se)
+	}
+}
+
+func validateMountConfig(cfg *MountConfig) error {
+	if cfg.DefaultQPS < 0 || cfg.DefaultLeaseDuration < 0 || cfg.MaxLeaseDuration < 0 || cfg.MaxTTL < 0 || cfg.V2LeaseDuration < 0 {
+		return errors.New("default QPS and lease durations must not be negative")
+	}
+	if cfg.MaxLeaseDuration > maxV3TokenLife {
+		return fmt.Errorf("max_lease_duration must not exceed %d seconds", maxV3TokenLife)
+	}
+	if cfg.V2ClockOffset < -maxV2ClockOffset || cfg.V2ClockOffset > maxV2ClockOffset {
+		return fmt.Errorf("v2_clock_offset must be within %d seconds", maxV2ClockOffset)
+	}
+	if cfg.DefaultLeaseDuration > cfg.maxLeaseDuration() {
+		return errors.New("default_lease_duration must not exceed max_lease_duration")
+	}
+	for _, v := range cfg.AllowedVersions {
+		if v != apiVersionV2 && v != apiVersionV3 {
+			return fmt.Errorf("unsupported API version '%s'", v)
+		}
+	}
+
+	return validateTransport(cfg.TransportRec)
+}
+
+func (b *AuthPlugin) handleDeleteConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, configStoragePath); err != nil {
+		return nil, errwrap.Wrapf("failed to delete mount configuration: {{err}}", err)
+	}
+
+	return nil, nil
+}
@@ -6,14 +6,32 @@ import (
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
 	credentialsName   = "masheryCredentialsName"
+	areaStoragePrefix = "area/"
+
+	listPrefixField = "prefix"
+	listAfterField  = "after"
+	listLimitField  = "limit"
+
+	pathAreasListHelpSyn  = "Lists stored Mashery credentials"
+	pathAreasListHelpDesc = `
+Lists the logical names of the Mashery credentials stored in this mount. The names are returned in the
+lexicographical order. The output can be narrowed down to the names starting with a given prefix. Large mounts
+can be paged through by specifying the last name seen in the previous page as 'after' together with the 'limit'
+on the number of names to be returned.`
+
 	pathAreasHelpSyn  = "Saves Mashery credentials"
 	pathAreasHelpDesc = `
-The path is write-only storage of Mashery credentials required to obtain the V2/V3 authentication tokens. This path 
-is used first before authentication tokens can be retrieved. That path accepts configuration for both V2 and V3
+The path is a storage of Mashery credentials required to obtain the V2/V3 authentication tokens. This path 
+is used first before authentication tokens can be retrieved. Reading this path returns only non-sensitive
+fields of the credentials together with masked API key and username, and whether the stored data is sufficient
+to obtain V2 and/or V3 credentials. That path accepts configuration for both V2 and V3
 Mashery API. The user is recommended to always follow the least-required principle and suppply only fields that are 
 require for intended authentication methods.
 
@@ -32,7 +50,7 @@ access credentials.`
 func pathAreaData(b *AuthPlugin) *framework.Path {
 	return &framework.Path{
 		Pattern: "credentials/" + framework.GenericNameWithAtRegex(credentialsName),
-		Fields: map[string]*framework.FieldSchema{
+		Fields: transportFieldSchemas(map[string]*framework.FieldSchema{
 			credentialsName: {
 				Type:        framework.TypeString,
 				Description: "Mashery Area logical name",
@@ -74,21 +92,66 @@ func pathAreaData(b *AuthPlugin) *framework.Path {
 			},
 			secretQpsField: {
 				Type:        framework.TypeInt,
-				Description: "Maximum QPS this key can make. Recommended for all methods; defaults to 2",
+				Description: "Maximum QPS this key can make. Recommended for all methods; defaults to the mount configuration",
 				DisplayName: "Maximum V3 QPS",
-				Default:     2,
 			},
 			secretLeaseDurationField: {
 				Type:        framework.TypeDurationSecond,
-				Description: "Lease duration (for the access token). Optional for V3 credentials",
+				Description: "Lease duration (for the access token). Optional for V3 credentials; defaults to the mount configuration",
 				DisplayName: "Lease duration of V3 access token",
-				Default:     900,
 			},
-		},
+			secretEnforceQpsField: {
+				Type:        framework.TypeBool,
+				Description: "Split QPS between the outstanding leases such that their sum does not exceed qps",
+				DisplayName: "Enforce QPS budget",
+				Default:     false,
+			},
+			secretCacheTokenField: {
+				Type:        framework.TypeBool,
+				Description: "Share the cached V3 access token between the leases instead of obtaining a token per lease",
+				DisplayName: "Cache V3 access token",
+				Default:     false,
+			},
+			secretRotationPeriod: {
+				Type:        framework.TypeDurationSecond,
+				Description: "Rotate the V3 password automatically after this period; 0 disables automatic rotation",
+				DisplayName: "Password rotation period",
+			},
+			secretVerifyField: {
+				Type:        framework.TypeBool,
+				Description: "Verify the credentials with Mashery before saving them",
+				DisplayName: "Verify credentials",
+				Default:     false,
+			},
+			secretSigAlgorithmField: {
+				Type:        framework.TypeString,
+				Description: "Digest algorithm of V2 signatures: md5 (Mashery, default) or sha256",
+				DisplayName: "V2 signature algorithm",
+			},
+			secretSigEncodingField: {
+				Type:        framework.TypeString,
+				Description: "Encoding of V2 signatures: hex (Mashery, default) or base64",
+				DisplayName: "V2 signature encoding",
+			},
+			secretSigTimestampField: {
+				Type:        framework.TypeString,
+				Description: "Resolution of the time V2 signatures are salted with: seconds (Mashery, default) or millis",
+				DisplayName: "V2 signature timestamp",
+			},
+			secretClearFieldsField: {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Fields to remove from the stored credentials on update, e.g. username,password to make these V2-only",
+				DisplayName: "Fields to clear",
+			},
+		}),
 
 		ExistenceCheck: b.siteExistenceCheck,
 
 		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleReadAreaData,
+				Summary:  "Read non-sensitive Mashery area authentication data",
+			},
 			logical.CreateOperation: &framework.PathOperation{
 				Callback: b.handleWriteAreaData,
 				Summary:  "Store Mashery area authentication data",
@@ -107,6 +170,69 @@ func pathAreaData(b *AuthPlugin) *framework.Path {
 	}
 }
 
+func pathAreaList(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials/?$",
+		Fields: map[string]*framework.FieldSchema{
+			listPrefixField: {
+				Type:        framework.TypeString,
+				Description: "Return only logical names starting with this prefix",
+				DisplayName: "Name prefix",
+			},
+			listAfterField: {
+				Type:        framework.TypeString,
+				Description: "Return only logical names that follow this name. Used for paging",
+				DisplayName: "Start after",
+			},
+			listLimitField: {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of names to return; 0 returns all names",
+				DisplayName: "Page size",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.handleListAreaData,
+				Summary:  "List logical names of stored Mashery credentials",
+			},
+		},
+		HelpSynopsis:    pathAreasListHelpSyn,
+		HelpDescription: pathAreasListHelpDesc,
+	}
+}
+
+func (b *AuthPlugin) handleListAreaData(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	keys, err := req.Storage.List(ctx, areaStoragePrefix)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list site data: {{err}}", err)
+	}
+
+	limit := data.Get(listLimitField).(int)
+	if limit < 0 {
+		return logical.ErrorResponse("limit must not be negative"), nil
+	}
+
+	prefix := data.Get(listPrefixField).(string)
+	after := data.Get(listAfterField).(string)
+
+	sort.Strings(keys)
+
+	var retVal []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) || (len(after) > 0 && k <= after) {
+			continue
+		}
+
+		retVal = append(retVal, k)
+		if limit > 0 && len(retVal) == limit {
+			break
+		}
+	}
+
+	return logical.ListResponse(retVal), nil
+}
+
 func (b *AuthPlugin) siteExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
 	if out, err := req.Storage.Get(ctx, storagePathForMasheryArea(data)); err != nil {
 		return false, errwrap.Wrapf("existence check failed: {{err}}", err)
@@ -118,16 +244,13 @@ func (b *AuthPlugin) siteExistenceCheck(ctx context.Context, req *logical.Reques
 func storagePathForMasheryArea(data *framework.FieldData) string {
 	siteName := data.Get(credentialsName).(string)
 
-	return "area/" + siteName
+	return areaStoragePrefix + siteName
 }
 
 func toV3AuthRec(b *AuthPlugin, data *framework.FieldData) AuthRec {
 	retVal := AuthRec{}
 
 	mergeSiteFieldsInto(data, &retVal)
-	if retVal.LeaseDuration == 0 {
-		retVal.LeaseDuration = 15 * 60
-	}
 
 	b.Logger().Info(fmt.Sprintf("Lease duration for access token is %d", retVal.LeaseDuration))
 	return retVal
@@ -145,44 +268,92 @@ func mergeSiteFieldsInto(data *framework.FieldData, retVal *AuthRec) {
 	}
 	if keySecretRaw, ok := data.GetOk(secretKeySecretField); ok {
 		retVal.KeySecret = keySecretRaw.(string)
+		retVal.SecretRotatedAt = time.Now().Unix()
+		retVal.PreviousKeySecret = ""
+		retVal.PreviousSecretValidUntil = 0
+		retVal.PendingKeySecret = ""
 	}
 	if usernameRaw, ok := data.GetOk(secretUsernameField); ok {
 		retVal.Username = usernameRaw.(string)
 	}
 	if passwordRaw, ok := data.GetOk(secretPasswordField); ok {
 		retVal.Password = passwordRaw.(string)
+		retVal.PasswordRotatedAt = time.Now().Unix()
+		retVal.PendingPassword = ""
+	}
+	if periodRaw, ok := data.GetOk(secretRotationPeriod); ok {
+		retVal.PasswordRotationPeriod = periodRaw.(int)
+	}
+	if algRaw, ok := data.GetOk(secretSigAlgorithmField); ok {
+		retVal.SigAlgorithm = strings.ToLower(strings.TrimSpace(algRaw.(string)))
+	}
+	if encRaw, ok := data.GetOk(secretSigEncodingField); ok {
+		retVal.SigEncoding = strings.ToLower(strings.TrimSpace(encRaw.(string)))
+	}
+	if tsRaw, ok := data.GetOk(secretSigTimestampField); ok {
+		retVal.SigTimestamp = strings.ToLower(strings.TrimSpace(tsRaw.(string)))
 	}
 
 	if secretQpsRaw, ok := data.GetOk(secretQpsField); ok {
 		retVal.MaxQPS = secretQpsRaw.(int)
-	} else {
-		retVal.MaxQPS = 2
+	}
+
+	if enforceRaw, ok := data.GetOk(secretEnforceQpsField); ok {
+		retVal.EnforceQPS = enforceRaw.(bool)
+	}
+
+	mergeTransportFieldsInto(data, &retVal.TransportRec)
+
+	if cacheRaw, ok := data.GetOk(secretCacheTokenField); ok {
+		retVal.CacheToken = cacheRaw.(bool)
 	}
 
 	if durationRaw, ok := data.GetOk(secretLeaseDurationField); ok {
 		retVal.LeaseDuration = durationRaw.(int)
-
-		if retVal.LeaseDuration == 0 {
-			retVal.LeaseDuration = 15 * 60
-		}
 	}
 }
 
 func (b *AuthPlugin) handleWriteAreaData(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	return persistAuthRecord(ctx, req, data, toV3AuthRec(b, data))
+	b.credsLock.Lock()
+	defer b.credsLock.Unlock()
+
+	return b.verifyAndPersistAuthRecord(ctx, req, data, toV3AuthRec(b, data))
 }
 
-func persistAuthRecord(ctx context.Context, req *logical.Request, data *framework.FieldData, v3Rec AuthRec) (*logical.Response, error) {
-	if se, err := logical.StorageEntryJSON(storagePathForMasheryArea(data), v3Rec); err != nil {
-		return nil, errwrap.Wrapf("failed to save site data: {{err}}", err)
-	} else {
-		err = req.Storage.Put(ctx, se)
-		return nil, err
+func (b *AuthPlugin) verifyAndPersistAuthRecord(ctx context.Context, req *logical.Request, data *framework.FieldData, v3Rec AuthRec) (*logical.Response, error) {
+	normalizeAuthRec(&v3Rec)
+	if fe := validateAuthRecFields(data, &v3Rec); len(fe) > 0 {
+		return fe.asResponse(), nil
+	}
+
+	errResp, warnings := b.verifyBeforePersist(ctx, req.Storage, data, &v3Rec)
+	if errResp != nil {
+		return errResp, nil
 	}
+
+	resp, err := persistAuthRecord(ctx, req, data, v3Rec)
+	if err == nil && len(warnings) > 0 {
+		resp = &logical.Response{Warnings: warnings}
+	}
+
+	return resp, err
+}
+
+func persistAuthRecord(ctx context.Context, req *logical.Request, data *framework.FieldData, v3Rec AuthRec) (*logical.Response, error) {
+	credsName := data.Get(credentialsName).(string)
+	return nil, putAuthRecordVersion(ctx, req.Storage, credsName, &v3Rec, req.DisplayName, req.EntityID, versionOpWrite)
 }
 
 func getAuthRecord(ctx context.Context, req *logical.Request, data *framework.FieldData) (*AuthRec, error) {
-	if entry, err := req.Storage.Get(ctx, storagePathForMasheryArea(data)); err != nil {
+	return getAuthRecordAt(ctx, req.Storage, storagePathForMasheryArea(data))
+}
+
+func getAuthRecordByName(ctx context.Context, s logical.Storage, name string) (*AuthRec, error) {
+	return getAuthRecordAt(ctx, s, areaStoragePrefix+name)
+}
+
+func getAuthRecordAt(ctx context.Context, s logical.Storage, storagePath string) (*AuthRec, error) {
+	if entry, err := s.Get(ctx, storagePath); err != nil {
 		return nil, err
 	} else if entry == nil {
 		return nil, nil
@@ -197,17 +368,106 @@ func getAuthRecord(ctx context.Context, req *logical.Request, data *framework.Fi
 	}
 }
 
+// maskSensitive masks the sensitive value, leaving only a few leading characters visible to help the administrator
+// recognize the value.
+func maskSensitive(v string) string {
+	if len(v) == 0 {
+		return ""
+	}
+
+	visible := 0
+	if len(v) > 8 {
+		visible = 4
+	}
+
+	return v[:visible] + strings.Repeat("*", len(v)-visible)
+}
+
+func (b *AuthPlugin) handleReadAreaData(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if storedRec, err := getAuthRecord(ctx, req, data); err != nil {
+		return nil, err
+	} else if storedRec == nil {
+		return nil, nil
+	} else if v3Rec, err := b.withMountDefaults(ctx, req.Storage, storedRec); err != nil {
+		return nil, err
+	} else {
+		return &logical.Response{
+			Data: transportResponseData(v3Rec.TransportRec, map[string]interface{}{
+				secretAreaIdField:        v3Rec.AreaId,
+				secretAreaNidField:       v3Rec.AreaNid,
+				secretQpsField:           v3Rec.MaxQPS,
+				secretLeaseDurationField: v3Rec.LeaseDuration,
+				secretEnforceQpsField:    v3Rec.EnforceQPS,
+				secretCacheTokenField:    v3Rec.CacheToken,
+				secretRotationPeriod:     v3Rec.PasswordRotationPeriod,
+				secretPasswordRotatedAt:  v3Rec.PasswordRotatedAt,
+				secretSecretRotatedAt:    v3Rec.SecretRotatedAt,
+				secretPreviousValidUntil: v3Rec.PreviousSecretValidUntil,
+				secretSigAlgorithmField:  v3Rec.SigAlgorithm,
+				secretSigEncodingField:   v3Rec.SigEncoding,
+				secretSigTimestampField:  v3Rec.SigTimestamp,
+				secretApiKeField:         maskSensitive(v3Rec.ApiKey),
+				secretUsernameField:      maskSensitive(v3Rec.Username),
+				secretV2CapableField:     sufficientForV2(v3Rec),
+				secretV3CapableField:     sufficientForV3(v3Rec),
+			}),
+		}, nil
+	}
+}
+
 func (b *AuthPlugin) handleUpdateAreaData(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// The stored credentials are read and written back under the lock, so that the concurrent rotation is not lost.
+	b.credsLock.Lock()
+	defer b.credsLock.Unlock()
 
 	if v3Rec, err := getAuthRecord(ctx, req, data); err != nil {
 		return nil, err
 	} else {
+		clearFields := data.Get(secretClearFieldsField).([]string)
+		if fe := clearAuthRecFields(data, clearFields, v3Rec); len(fe) > 0 {
+			return fe.asResponse(), nil
+		}
+
 		mergeSiteFieldsInto(data, v3Rec)
-		return persistAuthRecord(ctx, req, data, *v3Rec)
+		resp, err := b.verifyAndPersistAuthRecord(ctx, req, data, *v3Rec)
+		if err != nil || len(clearFields) == 0 || (resp != nil && resp.IsError()) {
+			return resp, err
+		}
+
+		// Clearing fields may have changed which API versions the credentials can be used for.
+		if resp == nil {
+			resp = &logical.Response{}
+		}
+		resp.Data = map[string]interface{}{
+			secretV2CapableField: sufficientForV2(v3Rec),
+			secretV3CapableField: sufficientForV3(v3Rec),
+		}
+		if !sufficientForV2(v3Rec) && !sufficientForV3(v3Rec) {
+			resp.AddWarning("credentials are no longer sufficient for either V2 or V3 API")
+		}
+		return resp, nil
 	}
 }
 
 func (b *AuthPlugin) handleDeleteAreaData(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, storagePathForMasheryArea(data))
-	return nil, errwrap.Wrapf("failed to delete site data: {{err}}", err)
+	b.credsLock.Lock()
+	defer b.credsLock.Unlock()
+
+	if storedRec, err := getAuthRecord(ctx, req, data); err != nil {
+		return nil, err
+	} else if storedRec == nil {
+		return nil, nil
+	}
+
+	if err := req.Storage.Delete(ctx, storagePathForMasheryArea(data)); err != nil {
+		return nil, errwrap.Wrapf("failed to delete site data: {{err}}", err)
+	}
+
+	// The history is retained, so that the deleted credentials can be restored by rollback.
+	credsName := data.Get(credentialsName).(string)
+	if err := appendCredentialsVersion(ctx, req.Storage, credsName, &AuthRec{}, req.DisplayName, req.EntityID, versionOpDelete); err != nil {
+		return nil, errwrap.Wrapf("failed to record the delete in credentials history: {{err}}", err)
+	}
+
+	return nil, nil
 }
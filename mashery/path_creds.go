@@ -0,0 +1,124 @@
+package mashery
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const (
+	roleApiVersionField = "api_version"
+
+	pathRoleCredentialsHelpSyn  = "Issues Mashery V2 signature or V3 access token for a role"
+	pathRoleCredentialsHelpDesc = `
+Issues Mashery credentials on the terms defined by the role. The API version is selected by appending /v2 or /v3
+to the path. Without the suffix, V3 access token is issued if the role allows V3 API, otherwise V2 signature is
+issued.
+
+The issued secrets are equivalent to those issued from auth/<credentialsName>/v2 and auth/<credentialsName>/v3,
+except that the QPS and the lease duration are limited by the role, and the metadata bound to the role is included
+in the response.`
+)
+
+func pathRoleCredentials(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "creds/" + framework.GenericNameWithAtRegex(roleName) + "(/(?P<" + roleApiVersionField + ">v2|v3))?",
+		Fields: map[string]*framework.FieldSchema{
+			roleName: {
+				Type:        framework.TypeString,
+				Description: "Role name",
+			},
+			roleApiVersionField: {
+				Type:        framework.TypeString,
+				Description: "Mashery API version (v2 or v3)",
+			},
+			secretIncludeUrlField: {
+				Type:        framework.TypeBool,
+				Description: "Include the ready-to-use V2 request URL and headers in the V2 response",
+				Default:     false,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathReadRoleCredentials,
+				Summary:  "Issue Mashery credentials for the role",
+			},
+		},
+
+		HelpSynopsis:    pathRoleCredentialsHelpSyn,
+		HelpDescription: pathRoleCredentialsHelpDesc,
+	}
+}
+
+func (b *AuthPlugin) pathReadRoleCredentials(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get(roleName).(string)
+
+	role, err := getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	} else if role == nil {
+		return logical.ErrorResponse("role '%s' does not exist", name), nil
+	}
+
+	apiVersion := d.Get(roleApiVersionField).(string)
+	if len(apiVersion) == 0 {
+		if role.allows(apiVersionV3) {
+			apiVersion = apiVersionV3
+		} else {
+			apiVersion = apiVersionV2
+		}
+	}
+
+	if !role.allows(apiVersion) {
+		return logical.ErrorResponse("role '%s' does not allow %s credentials", name, apiVersion), nil
+	}
+
+	v3Rec, err := getAuthRecordByName(ctx, req.Storage, role.Credentials)
+	if err != nil {
+		return nil, err
+	} else if v3Rec == nil {
+		return logical.ErrorResponse("credentials '%s' of role '%s' are not stored", role.Credentials, name), nil
+	}
+
+	roleRec := role.applyTo(*v3Rec)
+
+	var resp *logical.Response
+	if apiVersion == apiVersionV2 {
+		resp, err = b.issueV2Signature(ctx, req, &roleRec, map[string]interface{}{
+			secretInternalSiteStoragePath: areaStoragePrefix + role.Credentials,
+			secretInternalRoleName:        name,
+		})
+	} else {
+		resp, err = b.issueV3AccessToken(ctx, req, &roleRec, map[string]interface{}{
+			secretInternalSiteStoragePath: areaStoragePrefix + role.Credentials,
+			secretInternalRoleName:        name,
+		})
+
+		if err == nil && resp.Secret != nil && role.MaxTTL > 0 {
+			maxTTL := time.Second * time.Duration(role.MaxTTL)
+			resp.Secret.LeaseOptions.MaxTTL = maxTTL
+			resp.Secret.LeaseOptions.TTL = capToRoleMaxTTL(role, time.Now(), resp.Secret.LeaseOptions.TTL)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	} else if resp.IsError() {
+		return resp, nil
+	}
+
+	if apiVersion == apiVersionV2 && d.Get(secretIncludeUrlField).(bool) {
+		if err := b.addV2RequestURL(ctx, req.Storage, v3Rec, resp); err != nil {
+			return nil, err
+		}
+	}
+	if len(role.Metadata) > 0 {
+		resp.Data[roleMetadataField] = role.Metadata
+	}
+	b.Logger().Info(fmt.Sprintf("Issued %s credentials for role %s", apiVersion, name))
+
+	return resp, nil
+}
@@ -0,0 +1,239 @@
+package mashery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"time"
+)
+
+const (
+	secretMemberIdField      = "member_id"
+	secretMemberUsername     = "member_username"
+	secretMemberEmail        = "member_email"
+	secretApplicationIdField = "application_id"
+
+	secretInternalMemberId      = "member_id"
+	secretInternalApplicationId = "application_id"
+
+	secretMasheryFixture = "member_fixture"
+
+	pathFixturesHelpSyn  = "Creates temporary Mashery member with an application for a role"
+	pathFixturesHelpDesc = `
+Creates a temporary Mashery member with an application attached, using the V3 credentials the role references.
+The member is named after the role and the email address of the member is in the role's fixture_email_domain.
+If the role specifies package_id and plan_id, a package key for this package and plan is created in
+the application.
+
+The identifiers of the member and the application, and the package key are returned as a lease. The application
+and the member are deleted from Mashery when the lease is revoked or expires. This is intended for integration
+tests that require Mashery objects to exist only for the duration of the test run.`
+)
+
+func pathFixtures(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "fixtures/" + framework.GenericNameWithAtRegex(roleName),
+		Fields: map[string]*framework.FieldSchema{
+			roleName: {
+				Type:        framework.TypeString,
+				Description: "Role name",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathReadFixture,
+				Summary:  "Create temporary Mashery member and application for the role",
+			},
+		},
+
+		HelpSynopsis:    pathFixturesHelpSyn,
+		HelpDescription: pathFixturesHelpDesc,
+	}
+}
+
+func fixtureSecret(b *AuthPlugin) *framework.Secret {
+	return &framework.Secret{
+		Type: secretMasheryFixture,
+		Fields: map[string]*framework.FieldSchema{
+			secretMemberIdField: {
+				Type:        framework.TypeString,
+				Description: "Mashery member id",
+			},
+			secretMemberUsername: {
+				Type:        framework.TypeString,
+				Description: "Mashery member username",
+			},
+			secretMemberEmail: {
+				Type:        framework.TypeString,
+				Description: "Mashery member email",
+			},
+			secretApplicationIdField: {
+				Type:        framework.TypeString,
+				Description: "Mashery application id",
+			},
+			secretApiKeField: {
+				Type:        framework.TypeString,
+				Description: "Package key created in the application, if the role specifies package and plan",
+			},
+			secretKeySecretField: {
+				Type:        framework.TypeString,
+				Description: "Package key secret",
+			},
+		},
+		DefaultDuration: time.Minute * 15,
+		Revoke:          b.revokeFixture,
+		Renew:           b.renewRoleBoundLease,
+	}
+}
+
+func (b *AuthPlugin) pathReadFixture(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get(roleName).(string)
+
+	role, err := getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	} else if role == nil {
+		return logical.ErrorResponse("role '%s' does not exist", name), nil
+	} else if !role.issuesFixtures() {
+		return logical.ErrorResponse("role '%s' does not define fixture template", name), nil
+	}
+
+	storedRec, err := getAuthRecordByName(ctx, req.Storage, role.Credentials)
+	if err != nil {
+		return nil, err
+	} else if storedRec == nil {
+		return logical.ErrorResponse("credentials '%s' of role '%s' are not stored", role.Credentials, name), nil
+	}
+
+	roleRec := role.applyTo(*storedRec)
+	v3Rec, err := b.withMountDefaults(ctx, req.Storage, &roleRec)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	username := fixtureUsername(name, suffix[:8])
+
+	var member *v3Member
+	var app *v3Application
+	var key *v3PackageKey
+
+	err = b.withV3Api(ctx, req.Storage, v3Rec, func(api *v3Api) error {
+		if member, err = api.createMember(v3Member{
+			Username:    username,
+			Email:       username + "@" + role.EmailDomain,
+			DisplayName: username,
+			AreaStatus:  "active",
+		}); err != nil {
+			return err
+		}
+
+		if app, err = api.createApplication(member.Id, v3Application{
+			Name:        username,
+			Description: fmt.Sprintf("Temporary application created by Vault for role %s", name),
+		}); err != nil {
+			b.deleteFixtureObjects(api, member.Id, "")
+			return err
+		}
+
+		if len(role.PackageId) > 0 {
+			if key, err = api.createPackageKey(app.Id, role.PackageId, role.PlanId); err != nil {
+				b.deleteFixtureObjects(api, member.Id, app.Id)
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errwrap.Wrapf("fixture was not created: {{err}}", err)
+	}
+
+	b.Logger().Info("Created fixture", "role", name, "member", member.Id, "application", app.Id)
+
+	data := map[string]interface{}{
+		secretMemberIdField:      member.Id,
+		secretMemberUsername:     member.Username,
+		secretMemberEmail:        member.Email,
+		secretApplicationIdField: app.Id,
+	}
+	if key != nil {
+		data[secretApiKeField] = key.Apikey
+		data[secretKeySecretField] = key.Secret
+		data[secretPackageKeyIdField] = key.Id
+	}
+	if len(role.Metadata) > 0 {
+		data[roleMetadataField] = role.Metadata
+	}
+
+	resp := b.Secret(secretMasheryFixture).Response(data, map[string]interface{}{
+		secretInternalSiteStoragePath: areaStoragePrefix + role.Credentials,
+		secretInternalRoleName:        name,
+		secretInternalMemberId:        member.Id,
+		secretInternalApplicationId:   app.Id,
+	})
+
+	resp.Secret.TTL = time.Second * time.Duration(v3Rec.LeaseDuration)
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = time.Second * time.Duration(role.MaxTTL)
+		resp.Secret.TTL = capToRoleMaxTTL(role, time.Now(), resp.Secret.TTL)
+	}
+
+	return resp, nil
+}
+
+// deleteFixtureObjects deletes the application (together with its package keys) and then the member.
+func (b *AuthPlugin) deleteFixtureObjects(api *v3Api, memberId string, appId string) error {
+	if len(appId) > 0 {
+		if err := api.deleteApplication(appId); err != nil {
+			b.Logger().Warn("Could not delete fixture application", "application", appId, "error", err)
+			return err
+		}
+	}
+
+	if err := api.deleteMember(memberId); err != nil {
+		b.Logger().Warn("Could not delete fixture member", "member", memberId, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (b *AuthPlugin) revokeFixture(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	memberId, ok := req.Secret.InternalData[secretInternalMemberId].(string)
+	if !ok || len(memberId) == 0 {
+		return nil, errors.New("secret does not bear member id")
+	}
+	appId, _ := req.Secret.InternalData[secretInternalApplicationId].(string)
+
+	v3Rec, err := b.getAuthRecordOfSecret(ctx, req)
+	if err != nil {
+		return nil, errwrap.Wrapf("error in retrieving v3 authentication record: {{err}}", err)
+	} else if v3Rec == nil {
+		return nil, errors.New("credentials of the fixture are no longer stored; the member must be deleted manually")
+	}
+
+	if err := b.withV3Api(ctx, req.Storage, v3Rec, func(api *v3Api) error {
+		return b.deleteFixtureObjects(api, memberId, appId)
+	}); err != nil {
+		return nil, errwrap.Wrapf("fixture was not deleted: {{err}}", err)
+	}
+
+	b.Logger().Info("Deleted fixture", "member", memberId, "application", appId)
+	return nil, nil
+}
+
+// fixtureUsername the name of the Mashery user created for the fixture of the role. The username is also the local
+// part of the email address of the user, so the '@' the role name may contain is replaced.
+func fixtureUsername(roleName string, suffix string) string {
+	return fmt.Sprintf("vault-%s-%s", strings.Replace(roleName, "@", "-", -1), suffix)
+}
@@ -0,0 +1,235 @@
+package mashery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+// Handoff passes issued credentials to a consumer that should not be able to read the credentials path itself,
+// e.g. an untrusted CI runner. Instead of the credentials, the requester receives a short-lived one-time code. The
+// consumer exchanges the code for the credentials at handoff/<code> exactly once. Only the hash of the code is
+// stored, so the codes cannot be recovered from the storage.
+
+const (
+	handoffStoragePrefix = "handoff/"
+
+	handoffCodeField      = "code"
+	handoffField          = "handoff"
+	handoffTTLField       = "handoff_ttl"
+	handoffExpiresAtField = "handoff_expires_at"
+
+	// Marks the leases whose credentials were handed off.
+	secretInternalHandedOff = "handed_off"
+
+	defaultHandoffTTL = 5 * 60
+	maxHandoffTTL     = 60 * 60
+
+	pathHandoffHelpSyn  = "Exchanges one-time handoff code for the issued Mashery credentials"
+	pathHandoffHelpDesc = `
+Returns the credentials issued from auth/<credentialsName>/v2 or auth/<credentialsName>/v3 with handoff=true in
+exchange for the one-time code returned to the requester. The code can be exchanged exactly once, and only before
+it expires. The lease of the credentials remains with the requester, who can revoke it once the consumer is done.
+
+The renewal of the V3 lease does not refresh the handed-off access token, as the refreshed token would not reach the
+consumer while the handed-off one would be invalidated. The lease can be renewed only while the handed-off token is
+valid.`
+)
+
+type handoffRec struct {
+	Data        map[string]interface{} `json:"data"`
+	Credentials string                 `json:"credentials"`
+	IssuedBy    string                 `json:"issued_by"`
+	ExpiryTime  int64                  `json:"expiry_time"`
+}
+
+func handoffFieldSchemas(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+	fields[handoffField] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: "Return a one-time code to be exchanged for the credentials at handoff/<code> instead of the credentials",
+		Default:     false,
+	}
+	fields[handoffTTLField] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: fmt.Sprintf("Time within which the handoff code must be exchanged. Defaults to %d seconds", defaultHandoffTTL),
+		Default:     defaultHandoffTTL,
+	}
+
+	return fields
+}
+
+func pathHandoff(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "handoff/" + framework.GenericNameRegex(handoffCodeField),
+		Fields: map[string]*framework.FieldSchema{
+			handoffCodeField: {
+				Type:        framework.TypeString,
+				Description: "One-time handoff code",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleRedeemHandoff,
+				Summary:  "Exchange one-time code for the issued credentials",
+			},
+		},
+
+		HelpSynopsis:    pathHandoffHelpSyn,
+		HelpDescription: pathHandoffHelpDesc,
+	}
+}
+
+func handoffIdOf(code string) string {
+	digest := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(digest[:])
+}
+
+// handoffLogId shortened id of the handoff that is written to the log.
+func handoffLogId(id string) string {
+	return id[:8]
+}
+
+// validateHandoff checks the handoff settings of the request. It is called before the credentials are issued, so
+// that the invalid settings do not leave the issued credentials behind.
+func validateHandoff(d *framework.FieldData) *logical.Response {
+	if ttl := d.Get(handoffTTLField).(int); d.Get(handoffField).(bool) && (ttl <= 0 || ttl > maxHandoffTTL) {
+		return logical.ErrorResponse("handoff_ttl must be between 1 and %d seconds", maxHandoffTTL)
+	}
+	return nil
+}
+
+// handOff replaces the data of the response carrying the issued credentials with the one-time code, if handoff was
+// requested. The issued credentials are released if the handoff cannot be saved.
+func (b *AuthPlugin) handOff(ctx context.Context, req *logical.Request, d *framework.FieldData, resp *logical.Response) (*logical.Response, error) {
+	if resp == nil || resp.IsError() || !d.Get(handoffField).(bool) {
+		return resp, nil
+	}
+
+	ttl := d.Get(handoffTTLField).(int)
+	code, err := uuid.GenerateUUID()
+	if err != nil {
+		b.releaseIssued(ctx, req, resp.Secret)
+		return nil, err
+	}
+
+	credsName := d.Get(credentialsName).(string)
+	rec := handoffRec{
+		Data:        resp.Data,
+		Credentials: credsName,
+		IssuedBy:    req.DisplayName,
+		ExpiryTime:  time.Now().Add(time.Second * time.Duration(ttl)).Unix(),
+	}
+
+	id := handoffIdOf(code)
+	if se, err := logical.StorageEntryJSON(handoffStoragePrefix+id, rec); err != nil {
+		b.releaseIssued(ctx, req, resp.Secret)
+		return nil, errwrap.Wrapf("failed to save handoff: {{err}}", err)
+	} else if err = req.Storage.Put(ctx, se); err != nil {
+		b.releaseIssued(ctx, req, resp.Secret)
+		return nil, errwrap.Wrapf("failed to save handoff: {{err}}", err)
+	}
+
+	resp.Secret.InternalData[secretInternalHandedOff] = true
+
+	b.Logger().Info("Issued handoff code", "credentials", credsName, "handoff", handoffLogId(id),
+		"requester", req.DisplayName, "expiry", rec.ExpiryTime)
+
+	resp.Data = map[string]interface{}{
+		handoffCodeField:      code,
+		handoffExpiresAtField: rec.ExpiryTime,
+	}
+	return resp, nil
+}
+
+// releaseIssued revokes the lease of the credentials that could not be handed off: the V3 access token is
+// invalidated, and the QPS allocated to the lease is released.
+func (b *AuthPlugin) releaseIssued(ctx context.Context, req *logical.Request, secret *logical.Secret) {
+	if secret == nil {
+		return
+	}
+
+	var err error
+	if secret.InternalData["secret_type"] == secretMasheryV3Access {
+		revokeReq := *req
+		revokeReq.Secret = secret
+		_, err = b.revokeV3AccessToken(ctx, &revokeReq, nil)
+	} else {
+		err = b.releaseQPS(ctx, req.Storage, secret.InternalData)
+	}
+
+	if err != nil {
+		b.Logger().Error("Could not release credentials that were not handed off", "error", err)
+	}
+}
+
+func (b *AuthPlugin) handleRedeemHandoff(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	id := handoffIdOf(d.Get(handoffCodeField).(string))
+	storagePath := handoffStoragePrefix + id
+
+	b.handoffLock.Lock()
+	defer b.handoffLock.Unlock()
+
+	entry, err := req.Storage.Get(ctx, storagePath)
+	if err != nil {
+		return nil, err
+	} else if entry == nil {
+		b.Logger().Warn("Unknown or already redeemed handoff code presented", "requester", req.DisplayName)
+		return logical.ErrorResponse("handoff code is unknown or was already used"), nil
+	}
+
+	// The code is invalidated before the credentials are returned, so that it cannot be used twice.
+	if err := req.Storage.Delete(ctx, storagePath); err != nil {
+		return nil, errwrap.Wrapf("failed to invalidate handoff code: {{err}}", err)
+	}
+
+	rec := handoffRec{}
+	if err := entry.DecodeJSON(&rec); err != nil {
+		return nil, errwrap.Wrapf("cannot unmarshal handoff ({{err}})", err)
+	}
+
+	if rec.ExpiryTime <= time.Now().Unix() {
+		b.Logger().Warn("Expired handoff code presented", "credentials", rec.Credentials, "handoff", handoffLogId(id),
+			"requester", req.DisplayName)
+		return logical.ErrorResponse("handoff code has expired"), nil
+	}
+
+	b.Logger().Info("Redeemed handoff code", "credentials", rec.Credentials, "handoff", handoffLogId(id),
+		"issued_by", rec.IssuedBy, "requester", req.DisplayName)
+	return &logical.Response{Data: rec.Data}, nil
+}
+
+// purgeExpiredHandoffs is run periodically to remove the handoffs that were not redeemed in time.
+func (b *AuthPlugin) purgeExpiredHandoffs(ctx context.Context, req *logical.Request) error {
+	ids, err := req.Storage.List(ctx, handoffStoragePrefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list handoffs: {{err}}", err)
+	}
+
+	b.handoffLock.Lock()
+	defer b.handoffLock.Unlock()
+
+	now := time.Now().Unix()
+	for _, id := range ids {
+		rec := handoffRec{}
+		if entry, err := req.Storage.Get(ctx, handoffStoragePrefix+id); err != nil || entry == nil {
+			continue
+		} else if err := entry.DecodeJSON(&rec); err == nil && rec.ExpiryTime > now {
+			continue
+		}
+
+		if err := req.Storage.Delete(ctx, handoffStoragePrefix+id); err != nil {
+			b.Logger().Error("Could not delete expired handoff", "handoff", handoffLogId(id), "error", err)
+		} else {
+			b.Logger().Info("Deleted expired handoff", "credentials", rec.Credentials, "handoff", handoffLogId(id))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package mashery
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const (
+	secretPackageKeyIdField = "package_key_id"
+
+	secretInternalPackageKeyId = "package_key_id"
+
+	secretMasheryPackageKey = "package_key"
+
+	pathKeysHelpSyn  = "Creates Mashery package key for a role"
+	pathKeysHelpDesc = `
+Creates a fresh Mashery package key for the package, plan, and application configured in the role. The key is
+created using the V3 credentials the role references, and is returned as a lease. The package key is deleted from
+Mashery when the lease is revoked or expires. This allows handing out throw-away keys e.g. to test environments
+instead of sharing long-lived keys.
+
+The lease duration is defined by the role's ttl (or lease duration of the credentials), and can be renewed up to
+the role's max_ttl.`
+)
+
+func pathKeys(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameWithAtRegex(roleName),
+		Fields: map[string]*framework.FieldSchema{
+			roleName: {
+				Type:        framework.TypeString,
+				Description: "Role name",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathReadPackageKey,
+				Summary:  "Create Mashery package key for the role",
+			},
+		},
+
+		HelpSynopsis:    pathKeysHelpSyn,
+		HelpDescription: pathKeysHelpDesc,
+	}
+}
+
+func packageKeySecret(b *AuthPlugin) *framework.Secret {
+	return &framework.Secret{
+		Type: secretMasheryPackageKey,
+		Fields: map[string]*framework.FieldSchema{
+			secretApiKeField: {
+				Type:        framework.TypeString,
+				Description: "Mashery package key",
+			},
+			secretKeySecretField: {
+				Type:        framework.TypeString,
+				Description: "Mashery package key secret",
+			},
+			secretPackageKeyIdField: {
+				Type:        framework.TypeString,
+				Description: "Mashery package key object id",
+			},
+		},
+		DefaultDuration: time.Minute * 15,
+		Revoke:          b.revokePackageKey,
+		Renew:           b.renewRoleBoundLease,
+	}
+}
+
+func (b *AuthPlugin) pathReadPackageKey(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get(roleName).(string)
+
+	role, err := getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	} else if role == nil {
+		return logical.ErrorResponse("role '%s' does not exist", name), nil
+	} else if !role.issuesPackageKeys() {
+		return logical.ErrorResponse("role '%s' does not define package, plan, and application", name), nil
+	}
+
+	storedRec, err := getAuthRecordByName(ctx, req.Storage, role.Credentials)
+	if err != nil {
+		return nil, err
+	} else if storedRec == nil {
+		return logical.ErrorResponse("credentials '%s' of role '%s' are not stored", role.Credentials, name), nil
+	}
+
+	roleRec := role.applyTo(*storedRec)
+	v3Rec, err := b.withMountDefaults(ctx, req.Storage, &roleRec)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *v3PackageKey
+	if err := b.withV3Api(ctx, req.Storage, v3Rec, func(api *v3Api) error {
+		key, err = api.createPackageKey(role.ApplicationId, role.PackageId, role.PlanId)
+		return err
+	}); err != nil {
+		return nil, errwrap.Wrapf("package key was not created: {{err}}", err)
+	}
+
+	b.Logger().Info("Created package key", "role", name, "id", key.Id)
+
+	resp := b.Secret(secretMasheryPackageKey).Response(map[string]interface{}{
+		secretApiKeField:        key.Apikey,
+		secretKeySecretField:    key.Secret,
+		secretPackageKeyIdField: key.Id,
+	}, map[string]interface{}{
+		secretInternalSiteStoragePath: areaStoragePrefix + role.Credentials,
+		secretInternalRoleName:        name,
+		secretInternalPackageKeyId:    key.Id,
+	})
+	if len(role.Metadata) > 0 {
+		resp.Data[roleMetadataField] = role.Metadata
+	}
+
+	resp.Secret.TTL = time.Second * time.Duration(v3Rec.LeaseDuration)
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = time.Second * time.Duration(role.MaxTTL)
+		resp.Secret.TTL = capToRoleMaxTTL(role, time.Now(), resp.Secret.TTL)
+	}
+
+	return resp, nil
+}
+
+// renewRoleBoundLease renews the lease of the Mashery object created for the role up to the max TTL of the role.
+func (b *AuthPlugin) renewRoleBoundLease(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := b.roleOfSecret(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	v3Rec, err := b.getAuthRecordOfSecret(ctx, req)
+	if err != nil {
+		return nil, err
+	} else if v3Rec == nil {
+		return nil, errors.New("credentials the lease was issued from are no longer stored")
+	}
+
+	if role != nil {
+		roleRec := role.applyTo(*v3Rec)
+		v3Rec = &roleRec
+	}
+	if v3Rec, err = b.withMountDefaults(ctx, req.Storage, v3Rec); err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = capToRoleMaxTTL(role, req.Secret.IssueTime, time.Second*time.Duration(v3Rec.LeaseDuration))
+	if resp.Secret.TTL <= 0 {
+		return nil, errors.New("lease cannot be renewed beyond maximum TTL of the role")
+	}
+
+	return resp, nil
+}
+
+func (b *AuthPlugin) revokePackageKey(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	keyId, ok := req.Secret.InternalData[secretInternalPackageKeyId].(string)
+	if !ok || len(keyId) == 0 {
+		return nil, errors.New("secret does not bear package key id")
+	}
+
+	v3Rec, err := b.getAuthRecordOfSecret(ctx, req)
+	if err != nil {
+		return nil, errwrap.Wrapf("error in retrieving v3 authentication record: {{err}}", err)
+	} else if v3Rec == nil {
+		return nil, errors.New("credentials of the package key are no longer stored; the key must be deleted manually")
+	}
+
+	// Unlike access tokens, package keys do not expire by themselves. The error is returned so that Vault
+	// retries the revocation.
+	if err := b.withV3Api(ctx, req.Storage, v3Rec, func(api *v3Api) error {
+		return api.deletePackageKey(keyId)
+	}); err != nil {
+		return nil, errwrap.Wrapf("package key was not deleted: {{err}}", err)
+	}
+
+	b.Logger().Info("Deleted package key", "id", keyId)
+	return nil, nil
+}
@@ -0,0 +1,403 @@
+package mashery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	roleName           = "roleName"
+	roleStoragePrefix  = "role/"
+	apiVersionV2       = "v2"
+	apiVersionV3       = "v3"
+	roleCredentials    = "credentials"
+	roleTTLField       = "ttl"
+	roleMaxTTLField    = "max_ttl"
+	roleAllowedVersion = "allowed_api_versions"
+	roleMetadataField  = "metadata"
+	rolePackageIdField = "package_id"
+	rolePlanIdField    = "plan_id"
+	roleAppIdField     = "application_id"
+	roleEmailDomain    = "fixture_email_domain"
+
+	secretInternalRoleName = "role"
+
+	pathRolesHelpSyn  = "Manages roles issuing Mashery credentials"
+	pathRolesHelpDesc = `
+A role references the stored Mashery credentials and defines the terms under which the V2 signatures and V3 access
+tokens are issued to the consumers of this role. A role can:
+- limit the QPS share of the credentials the consumers should use. The share can not exceed QPS stored with
+  the credentials;
+- define default (ttl) and maximum (max_ttl) duration of the V3 access token lease;
+- allow only V2, only V3, or both API versions; and
+- bind metadata that is returned with every issued secret;
+- define Mashery package, plan, and application for which the package keys are created by keys/<role>; and
+- define the template of the temporary members and applications created by fixtures/<role>.
+
+This allows issuing credentials with different limits to different consumers, e.g. a deployment pipeline and an OAuth
+server, that share the same Mashery package key. The credentials are issued from creds/<role>.`
+
+	pathRolesListHelpSyn  = "Lists roles issuing Mashery credentials"
+	pathRolesListHelpDesc = `
+Lists the names of the roles defined in this mount.`
+)
+
+// RoleRec role defining the terms of issuing the credentials stored in the referenced credentials.
+type RoleRec struct {
+	Credentials     string            `json:"credentials"`
+	MaxQPS          int               `json:"qps"`
+	TTL             int               `json:"ttl"`
+	MaxTTL          int               `json:"max_ttl"`
+	AllowedVersions []string          `json:"allowed_api_versions"`
+	Metadata        map[string]string `json:"metadata"`
+	PackageId       string            `json:"package_id,omitempty"`
+	PlanId          string            `json:"plan_id,omitempty"`
+	ApplicationId   string            `json:"application_id,omitempty"`
+	EmailDomain     string            `json:"fixture_email_domain,omitempty"`
+}
+
+func (r RoleRec) issuesPackageKeys() bool {
+	return len(r.PackageId) > 0 && len(r.PlanId) > 0 && len(r.ApplicationId) > 0
+}
+
+func (r RoleRec) issuesFixtures() bool {
+	return len(r.EmailDomain) > 0
+}
+
+func (r RoleRec) allows(apiVersion string) bool {
+	for _, v := range r.AllowedVersions {
+		if v == apiVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyTo derives the authentication record the consumers of this role are entitled to.
+func (r RoleRec) applyTo(v3Rec AuthRec) AuthRec {
+	if r.MaxQPS > 0 && (v3Rec.MaxQPS == 0 || r.MaxQPS < v3Rec.MaxQPS) {
+		v3Rec.MaxQPS = r.MaxQPS
+	}
+	if r.TTL > 0 {
+		v3Rec.LeaseDuration = r.TTL
+	}
+
+	return v3Rec
+}
+
+func pathRoles(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameWithAtRegex(roleName),
+		Fields: map[string]*framework.FieldSchema{
+			roleName: {
+				Type:        framework.TypeString,
+				Description: "Role name",
+				DisplayName: "Role name",
+			},
+			roleCredentials: {
+				Type:        framework.TypeString,
+				Description: "Logical name of the Mashery credentials this role issues",
+				DisplayName: "Credentials logical name",
+			},
+			secretQpsField: {
+				Type:        framework.TypeInt,
+				Description: "Maximum QPS share consumers of this role may use; cannot exceed QPS of the credentials",
+				DisplayName: "Maximum QPS share",
+			},
+			roleTTLField: {
+				Type:        framework.TypeDurationSecond,
+				Description: "Default lease duration of V3 access tokens; defaults to lease duration of the credentials",
+				DisplayName: "Default TTL",
+			},
+			roleMaxTTLField: {
+				Type:        framework.TypeDurationSecond,
+				Description: "Maximum lease duration of V3 access tokens including renewals",
+				DisplayName: "Maximum TTL",
+			},
+			roleAllowedVersion: {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Mashery API versions (v2, v3) this role issues credentials for",
+				DisplayName: "Allowed API versions",
+				Default:     []string{apiVersionV2, apiVersionV3},
+			},
+			roleMetadataField: {
+				Type:        framework.TypeKVPairs,
+				Description: "Metadata returned with every secret issued for this role",
+				DisplayName: "Bound metadata",
+			},
+			rolePackageIdField: {
+				Type:        framework.TypeString,
+				Description: "Mashery package id of the package keys created for this role",
+				DisplayName: "Package id",
+			},
+			rolePlanIdField: {
+				Type:        framework.TypeString,
+				Description: "Mashery plan id of the package keys created for this role",
+				DisplayName: "Plan id",
+			},
+			roleAppIdField: {
+				Type:        framework.TypeString,
+				Description: "Mashery application id the package keys are created in for this role",
+				DisplayName: "Application id",
+			},
+			roleEmailDomain: {
+				Type:        framework.TypeString,
+				Description: "Email domain of the temporary members created for this role; enables fixtures/<role>",
+				DisplayName: "Fixture email domain",
+			},
+		},
+
+		ExistenceCheck: b.roleExistenceCheck,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleReadRole,
+				Summary:  "Read role",
+			},
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.handleWriteRole,
+				Summary:  "Create role",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleWriteRole,
+				Summary:  "Update role",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.handleDeleteRole,
+				Summary:  "Delete role",
+			},
+		},
+		HelpSynopsis:    pathRolesHelpSyn,
+		HelpDescription: pathRolesHelpDesc,
+	}
+}
+
+func pathRolesList(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/?$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.handleListRoles,
+				Summary:  "List roles",
+			},
+		},
+		HelpSynopsis:    pathRolesListHelpSyn,
+		HelpDescription: pathRolesListHelpDesc,
+	}
+}
+
+func storagePathForRole(name string) string {
+	return roleStoragePrefix + name
+}
+
+func (b *AuthPlugin) roleExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	if out, err := req.Storage.Get(ctx, storagePathForRole(data.Get(roleName).(string))); err != nil {
+		return false, errwrap.Wrapf("existence check failed: {{err}}", err)
+	} else {
+		return out != nil, nil
+	}
+}
+
+func getRole(ctx context.Context, s logical.Storage, name string) (*RoleRec, error) {
+	if entry, err := s.Get(ctx, storagePathForRole(name)); err != nil {
+		return nil, err
+	} else if entry == nil {
+		return nil, nil
+	} else {
+		role := RoleRec{}
+
+		if err := entry.DecodeJSON(&role); err != nil {
+			return nil, errwrap.Wrapf("cannot unmarshal role data structure ({{err}})", err)
+		}
+
+		return &role, nil
+	}
+}
+
+func mergeRoleFieldsInto(data *framework.FieldData, role *RoleRec) {
+	if credsRaw, ok := data.GetOk(roleCredentials); ok {
+		role.Credentials = credsRaw.(string)
+	}
+	if qpsRaw, ok := data.GetOk(secretQpsField); ok {
+		role.MaxQPS = qpsRaw.(int)
+	}
+	if ttlRaw, ok := data.GetOk(roleTTLField); ok {
+		role.TTL = ttlRaw.(int)
+	}
+	if maxTTLRaw, ok := data.GetOk(roleMaxTTLField); ok {
+		role.MaxTTL = maxTTLRaw.(int)
+	}
+	if versionsRaw, ok := data.GetOk(roleAllowedVersion); ok {
+		role.AllowedVersions = versionsRaw.([]string)
+	} else if role.AllowedVersions == nil {
+		role.AllowedVersions = data.Get(roleAllowedVersion).([]string)
+	}
+	if metadataRaw, ok := data.GetOk(roleMetadataField); ok {
+		role.Metadata = metadataRaw.(map[string]string)
+	}
+	if packageRaw, ok := data.GetOk(rolePackageIdField); ok {
+		role.PackageId = packageRaw.(string)
+	}
+	if planRaw, ok := data.GetOk(rolePlanIdField); ok {
+		role.PlanId = planRaw.(string)
+	}
+	if appRaw, ok := data.GetOk(roleAppIdField); ok {
+		role.ApplicationId = appRaw.(string)
+	}
+	if domainRaw, ok := data.GetOk(roleEmailDomain); ok {
+		role.EmailDomain = domainRaw.(string)
+	}
+}
+
+func validateRole(role *RoleRec) error {
+	if len(role.Credentials) == 0 {
+		return errors.New("role must reference credentials")
+	}
+	if role.MaxQPS < 0 {
+		return errors.New("qps must not be negative")
+	}
+	if role.TTL < 0 || role.MaxTTL < 0 {
+		return errors.New("ttl and max_ttl must not be negative")
+	}
+	if role.MaxTTL > 0 && role.TTL > role.MaxTTL {
+		return errors.New("ttl must not exceed max_ttl")
+	}
+	if len(role.AllowedVersions) == 0 {
+		return errors.New("role must allow at least one API version")
+	}
+	for _, v := range role.AllowedVersions {
+		if v != apiVersionV2 && v != apiVersionV3 {
+			return fmt.Errorf("unsupported API version '%s'", v)
+		}
+	}
+	if (len(role.PackageId) > 0) != (len(role.PlanId) > 0) {
+		return errors.New("package_id and plan_id must be specified together")
+	}
+	if len(role.ApplicationId) > 0 && len(role.PackageId) == 0 {
+		return errors.New("application_id requires package_id and plan_id")
+	}
+	if strings.ContainsAny(role.EmailDomain, "@ ") {
+		return errors.New("fixture_email_domain must be a domain name")
+	}
+
+	return nil
+}
+
+func (b *AuthPlugin) handleWriteRole(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get(roleName).(string)
+
+	role, err := getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	} else if role == nil {
+		role = &RoleRec{}
+	}
+
+	mergeRoleFieldsInto(data, role)
+	if err := validateRole(role); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var resp *logical.Response
+	if storedRec, err := getAuthRecordByName(ctx, req.Storage, role.Credentials); err != nil {
+		return nil, err
+	} else if v3Rec, err := b.withMountDefaults(ctx, req.Storage, storedRec); err != nil {
+		return nil, err
+	} else if v3Rec == nil {
+		resp = &logical.Response{}
+		resp.AddWarning(fmt.Sprintf("credentials '%s' are not stored yet", role.Credentials))
+	} else if role.MaxQPS > v3Rec.MaxQPS {
+		return logical.ErrorResponse("qps share %d exceeds qps %d of the credentials", role.MaxQPS, v3Rec.MaxQPS), nil
+	}
+
+	if se, err := logical.StorageEntryJSON(storagePathForRole(name), role); err != nil {
+		return nil, errwrap.Wrapf("failed to save role: {{err}}", err)
+	} else if err = req.Storage.Put(ctx, se); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (b *AuthPlugin) handleReadRole(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if role, err := getRole(ctx, req.Storage, data.Get(roleName).(string)); err != nil {
+		return nil, err
+	} else if role == nil {
+		return nil, nil
+	} else {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				roleCredentials:    role.Credentials,
+				secretQpsField:     role.MaxQPS,
+				roleTTLField:       role.TTL,
+				roleMaxTTLField:    role.MaxTTL,
+				roleAllowedVersion: role.AllowedVersions,
+				roleMetadataField:  role.Metadata,
+				rolePackageIdField: role.PackageId,
+				rolePlanIdField:    role.PlanId,
+				roleAppIdField:     role.ApplicationId,
+				roleEmailDomain:    role.EmailDomain,
+			},
+		}, nil
+	}
+}
+
+func (b *AuthPlugin) handleDeleteRole(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, storagePathForRole(data.Get(roleName).(string))); err != nil {
+		return nil, errwrap.Wrapf("failed to delete role: {{err}}", err)
+	}
+
+	return nil, nil
+}
+
+func (b *AuthPlugin) handleListRoles(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if keys, err := req.Storage.List(ctx, roleStoragePrefix); err != nil {
+		return nil, errwrap.Wrapf("failed to list roles: {{err}}", err)
+	} else {
+		sort.Strings(keys)
+		return logical.ListResponse(keys), nil
+	}
+}
+
+// roleOfSecret returns the role the secret was issued for, or nil if the secret was issued directly from the
+// credentials.
+func (b *AuthPlugin) roleOfSecret(ctx context.Context, req *logical.Request) (*RoleRec, error) {
+	if req.Secret == nil || req.Secret.InternalData == nil {
+		return nil, nil
+	}
+
+	if name, ok := req.Secret.InternalData[secretInternalRoleName].(string); !ok || len(name) == 0 {
+		return nil, nil
+	} else {
+		return getRole(ctx, req.Storage, name)
+	}
+}
+
+// capToRoleMaxTTL reduces the lease duration such that the lease, counting from the issue time, would not exceed
+// the maximum TTL of the role.
+func capToRoleMaxTTL(role *RoleRec, issueTime time.Time, ttl time.Duration) time.Duration {
+	if role == nil || role.MaxTTL <= 0 {
+		return ttl
+	}
+
+	return capToMaxTTL(time.Second*time.Duration(role.MaxTTL), issueTime, ttl)
+}
+
+// capToMaxTTL reduces the lease duration such that the lease, counting from the issue time, would not exceed the
+// maximum TTL.
+func capToMaxTTL(maxTTL time.Duration, issueTime time.Time, ttl time.Duration) time.Duration {
+	if remaining := maxTTL - time.Since(issueTime); remaining < ttl {
+		return remaining
+	}
+
+	return ttl
+}
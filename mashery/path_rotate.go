@@ -0,0 +1,310 @@
+package mashery
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	generatedPasswordLength = 24
+
+	// Delay before the failed scheduled password rotation is attempted again; it doubles with each further failure.
+	passwordRotationRetryDelay    = time.Minute * 5
+	passwordRotationMaxRetryDelay = time.Hour * 6
+
+	pathAreaRotatePasswordHelpSyn  = "Rotates the Mashery V3 user password of the stored credentials"
+	pathAreaRotatePasswordHelpDesc = `
+Generates a new password for the Mashery user of the stored V3 credentials, and changes the password of this user
+in Mashery. The new password is saved as pending before it is sent to Mashery, and replaces the stored password only
+after the new password was confirmed by obtaining an access token with it. If the confirmation fails, or Mashery
+does not respond to the password change, the stored password is left unchanged and the pending password is kept.
+The next rotation first confirms which of the two passwords is in effect, and discards the pending password only
+if Mashery still accepts the stored one. The pending password is discarded immediately when Mashery rejects the
+change.
+
+The password can also be rotated automatically by specifying 'password_rotation_period' for the credentials. The
+rotation is then performed in the background once the period since the last password change has elapsed. A failed
+background rotation is retried after 5 minutes; the delay doubles with each further failure up to 6 hours.`
+
+	passwordCharsLower   = "abcdefghijklmnopqrstuvwxyz"
+	passwordCharsUpper   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	passwordCharsDigits  = "0123456789"
+	passwordCharsSpecial = "!#%*+-=?_"
+)
+
+func pathAreaRotatePassword(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials/" + framework.GenericNameWithAtRegex(credentialsName) + "/rotate-password",
+		Fields: map[string]*framework.FieldSchema{
+			credentialsName: {
+				Type:        framework.TypeString,
+				Description: "Mashery Area logical name",
+				DisplayName: "Area's logical name",
+			},
+		},
+
+		ExistenceCheck: b.siteExistenceCheck,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleRotatePassword,
+				Summary:  "Rotate Mashery V3 user password",
+			},
+		},
+		HelpSynopsis:    pathAreaRotatePasswordHelpSyn,
+		HelpDescription: pathAreaRotatePasswordHelpDesc,
+	}
+}
+
+func (b *AuthPlugin) handleRotatePassword(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	credsName := data.Get(credentialsName).(string)
+
+	if rotatedAt, err := b.rotatePassword(ctx, req.Storage, credsName); err != nil {
+		return logical.ErrorResponse("password was not rotated: %s", err), nil
+	} else {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				secretPasswordRotatedAt: rotatedAt,
+			},
+		}, nil
+	}
+}
+
+// generatePassword generates a random password containing lower- and upper-case letters, digits, and special
+// characters.
+func generatePassword() (string, error) {
+	return randomString(generatedPasswordLength, passwordCharsLower, passwordCharsUpper, passwordCharsDigits, passwordCharsSpecial)
+}
+
+// randomString generates a random string of the specified length that contains at least one character of each
+// character class.
+func randomString(length int, classes ...string) (string, error) {
+	all := strings.Join(classes, "")
+
+	retVal := make([]byte, length)
+	for i := range retVal {
+		charset := all
+		// The first characters guarantee that each character class is present.
+		if i < len(classes) {
+			charset = classes[i]
+		}
+
+		if c, err := randomCharOf(charset); err != nil {
+			return "", err
+		} else {
+			retVal[i] = c
+		}
+	}
+
+	// Shuffle the guaranteed characters into random positions.
+	for i := len(retVal) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		retVal[i], retVal[j.Int64()] = retVal[j.Int64()], retVal[i]
+	}
+
+	return string(retVal), nil
+}
+
+func randomCharOf(charset string) (byte, error) {
+	if n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset)))); err != nil {
+		return 0, err
+	} else {
+		return charset[n.Int64()], nil
+	}
+}
+
+// confirmPassword checks that Mashery grants an access token with the specified password.
+func (b *AuthPlugin) confirmPassword(ctx context.Context, s logical.Storage, v3Rec AuthRec, password string) error {
+	v3Rec.Password = password
+
+	helper, err := b.oauthHelperOf(ctx, s, &v3Rec)
+	if err != nil {
+		return err
+	}
+
+	v3Credentials := v3Rec.asV3Credentials()
+	tkn, err := helper.RetrieveAccessTokenFor(&v3Credentials)
+	if err != nil {
+		return err
+	}
+
+	if _, err = helper.ExchangeRefreshToken(&v3Credentials, tkn.RefreshToken); err != nil {
+		b.Logger().Warn("Could not invalidate the access token obtained for password confirmation", "error", err)
+	}
+	return nil
+}
+
+func putAuthRecordByName(ctx context.Context, s logical.Storage, credsName string, v3Rec *AuthRec) error {
+	if se, err := logical.StorageEntryJSON(areaStoragePrefix+credsName, v3Rec); err != nil {
+		return errwrap.Wrapf("failed to save site data: {{err}}", err)
+	} else {
+		return s.Put(ctx, se)
+	}
+}
+
+// rotatePassword changes the password of the Mashery user of the credentials and returns the time of the change.
+// The new password is persisted as pending before it is sent to Mashery, so that the new password is not lost if
+// the stored credentials could not be updated afterwards.
+func (b *AuthPlugin) rotatePassword(ctx context.Context, s logical.Storage, credsName string) (int64, error) {
+	b.credsLock.Lock()
+	defer b.credsLock.Unlock()
+
+	v3Rec, err := getAuthRecordByName(ctx, s, credsName)
+	if err != nil {
+		return 0, err
+	} else if v3Rec == nil {
+		return 0, fmt.Errorf("credentials '%s' are not stored", credsName)
+	} else if !sufficientForV3(v3Rec) {
+		return 0, errors.New("credentials are not sufficient for V3 API")
+	}
+
+	now := time.Now().Unix()
+
+	// The pending password left by the previous rotation could have been accepted by Mashery. It is discarded only
+	// once the stored password is confirmed to be still in effect.
+	if len(v3Rec.PendingPassword) > 0 {
+		if err := b.confirmPassword(ctx, s, *v3Rec, v3Rec.PendingPassword); err == nil {
+			b.Logger().Info("Pending password of the previous rotation was accepted", "credentials", credsName)
+
+			v3Rec.Password = v3Rec.PendingPassword
+			v3Rec.PendingPassword = ""
+			v3Rec.PasswordRotatedAt = now
+			return now, putAuthRecordVersion(ctx, s, credsName, v3Rec, versionActorPlugin, "", versionOpRotatePassword)
+		} else if err := b.confirmPassword(ctx, s, *v3Rec, v3Rec.Password); err != nil {
+			return 0, errwrap.Wrapf("cannot confirm whether the pending password of the previous rotation was applied: {{err}}", err)
+		}
+
+		b.Logger().Info("Pending password of the previous rotation was not applied", "credentials", credsName)
+	}
+
+	newPassword, err := generatePassword()
+	if err != nil {
+		return 0, errwrap.Wrapf("cannot generate password: {{err}}", err)
+	}
+
+	v3Rec.PendingPassword = newPassword
+	if err := putAuthRecordByName(ctx, s, credsName, v3Rec); err != nil {
+		return 0, err
+	}
+
+	changeSent := false
+	err = b.withV3Api(ctx, s, v3Rec, func(api *v3Api) error {
+		if member, err := api.findMemberByUsername(v3Rec.Username); err != nil {
+			return err
+		} else if member == nil {
+			return fmt.Errorf("mashery user '%s' was not found", v3Rec.Username)
+		} else {
+			changeSent = true
+			return api.changeMemberPassword(member.Id, newPassword)
+		}
+	})
+	if err != nil {
+		// Mashery could have applied the change without responding; the next rotation confirms which password works.
+		if changeSent && !rejectedByMashery(err) {
+			return 0, errwrap.Wrapf("outcome of the password change is unknown; the new password is kept as pending: {{err}}", err)
+		}
+
+		v3Rec.PendingPassword = ""
+		if putErr := putAuthRecordByName(ctx, s, credsName, v3Rec); putErr != nil {
+			b.Logger().Error("Could not discard pending password", "credentials", credsName, "error", putErr)
+		}
+		return 0, errwrap.Wrapf("mashery did not change the password: {{err}}", err)
+	}
+
+	if err := b.confirmPassword(ctx, s, *v3Rec, newPassword); err != nil {
+		// The pending password is retained; the next rotation will try it again.
+		return 0, errwrap.Wrapf("new password could not be confirmed and is kept as pending: {{err}}", err)
+	}
+
+	v3Rec.Password = newPassword
+	v3Rec.PendingPassword = ""
+	v3Rec.PasswordRotatedAt = now
+	if err := putAuthRecordVersion(ctx, s, credsName, v3Rec, versionActorPlugin, "", versionOpRotatePassword); err != nil {
+		return 0, err
+	}
+
+	b.Logger().Info("Rotated Mashery V3 password", "credentials", credsName)
+	return now, nil
+}
+
+// passwordRotationAttempt the last failed scheduled rotation of the password of the credentials, and the number of
+// the failures in a row.
+type passwordRotationAttempt struct {
+	at       time.Time
+	failures int
+}
+
+// retryAt the time before which the rotation is not attempted again.
+func (a passwordRotationAttempt) retryAt() time.Time {
+	delay := passwordRotationRetryDelay
+	for i := 1; i < a.failures && delay < passwordRotationMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > passwordRotationMaxRetryDelay {
+		delay = passwordRotationMaxRetryDelay
+	}
+
+	return a.at.Add(delay)
+}
+
+// rotateDuePasswords is run periodically to rotate the passwords of the credentials whose rotation period has
+// elapsed since the last password change. The failed rotation is retried with the increasing delay, so that
+// Mashery is not asked to change the password on every run of the periodic function.
+func (b *AuthPlugin) rotateDuePasswords(ctx context.Context, req *logical.Request) error {
+	names, err := req.Storage.List(ctx, areaStoragePrefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list site data: {{err}}", err)
+	}
+
+	b.rotationLock.Lock()
+	defer b.rotationLock.Unlock()
+
+	now := time.Now()
+	var errs []string
+	for _, credsName := range names {
+		v3Rec, err := getAuthRecordByName(ctx, req.Storage, credsName)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("credentials '%s': %s", credsName, err))
+			continue
+		} else if v3Rec == nil || v3Rec.PasswordRotationPeriod <= 0 || !sufficientForV3(v3Rec) {
+			delete(b.rotationAttempts, credsName)
+			continue
+		}
+
+		if v3Rec.PasswordRotatedAt+int64(v3Rec.PasswordRotationPeriod) > now.Unix() {
+			delete(b.rotationAttempts, credsName)
+			continue
+		}
+
+		attempt, retried := b.rotationAttempts[credsName]
+		if retried && now.Before(attempt.retryAt()) {
+			continue
+		}
+
+		if _, err := b.rotatePassword(ctx, req.Storage, credsName); err != nil {
+			attempt = passwordRotationAttempt{at: now, failures: attempt.failures + 1}
+			b.rotationAttempts[credsName] = attempt
+
+			b.Logger().Error("Scheduled password rotation failed", "credentials", credsName, "failures", attempt.failures, "retry_at", attempt.retryAt(), "error", err)
+			errs = append(errs, fmt.Sprintf("credentials '%s': %s", credsName, err))
+		} else {
+			delete(b.rotationAttempts, credsName)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("scheduled password rotation failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
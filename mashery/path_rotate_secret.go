@@ -0,0 +1,196 @@
+package mashery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const (
+	rotateOverlapField = "overlap"
+
+	generatedSecretLength = 10
+	defaultSecretOverlap  = 60 * 60
+
+	pathAreaRotateSecretHelpSyn  = "Rotates the Mashery package key secret of the stored credentials"
+	pathAreaRotateSecretHelpDesc = `
+Generates a new secret of the Mashery package key of the stored credentials, and changes the secret of this key
+in Mashery using the stored V3 credentials. The new secret is saved as pending before it is sent to Mashery, and
+replaces the stored secret once Mashery accepted the change. If Mashery does not respond to the change, the pending
+secret is kept, and the next rotation first reads the secret of the package key from Mashery: the pending secret
+replaces the stored secret if Mashery applied it, and is discarded otherwise. The pending secret is discarded
+immediately when Mashery rejects the change.
+
+The previous secret remains in use during the overlap window: V2 signatures are additionally returned signed with
+the previous secret as 'sig_previous', and V3 access tokens are requested with the previous secret if Mashery does
+not grant these with the new one. This gives the consumers and Mashery nodes time to pick up the new secret.`
+)
+
+func pathAreaRotateSecret(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials/" + framework.GenericNameWithAtRegex(credentialsName) + "/rotate-secret",
+		Fields: map[string]*framework.FieldSchema{
+			credentialsName: {
+				Type:        framework.TypeString,
+				Description: "Mashery Area logical name",
+				DisplayName: "Area's logical name",
+			},
+			rotateOverlapField: {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("Duration the previous secret remains in use. Defaults to %d seconds", defaultSecretOverlap),
+				DisplayName: "Overlap window",
+				Default:     defaultSecretOverlap,
+			},
+		},
+
+		ExistenceCheck: b.siteExistenceCheck,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleRotateSecret,
+				Summary:  "Rotate Mashery package key secret",
+			},
+		},
+		HelpSynopsis:    pathAreaRotateSecretHelpSyn,
+		HelpDescription: pathAreaRotateSecretHelpDesc,
+	}
+}
+
+func (b *AuthPlugin) handleRotateSecret(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	credsName := data.Get(credentialsName).(string)
+
+	overlap := data.Get(rotateOverlapField).(int)
+	if overlap < 0 {
+		return logical.ErrorResponse("overlap must not be negative"), nil
+	}
+
+	if v3Rec, err := b.rotateKeySecret(ctx, req.Storage, credsName, time.Second*time.Duration(overlap)); err != nil {
+		return logical.ErrorResponse("secret was not rotated: %s", err), nil
+	} else {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				secretSecretRotatedAt:    v3Rec.SecretRotatedAt,
+				secretPreviousValidUntil: v3Rec.PreviousSecretValidUntil,
+			},
+		}, nil
+	}
+}
+
+// rotateKeySecret changes the secret of the package key of the credentials. The previous secret is retained for
+// the overlap duration.
+func (b *AuthPlugin) rotateKeySecret(ctx context.Context, s logical.Storage, credsName string, overlap time.Duration) (*AuthRec, error) {
+	b.credsLock.Lock()
+	defer b.credsLock.Unlock()
+
+	v3Rec, err := getAuthRecordByName(ctx, s, credsName)
+	if err != nil {
+		return nil, err
+	} else if v3Rec == nil {
+		return nil, fmt.Errorf("credentials '%s' are not stored", credsName)
+	} else if !sufficientForV3(v3Rec) {
+		return nil, errors.New("credentials are not sufficient for V3 API")
+	}
+
+	// The pending secret left by the previous rotation could have been applied by Mashery.
+	if len(v3Rec.PendingKeySecret) > 0 {
+		if applied, err := b.pendingSecretApplied(ctx, s, v3Rec); err != nil {
+			return nil, errwrap.Wrapf("cannot confirm whether the pending secret of the previous rotation was applied: {{err}}", err)
+		} else if applied {
+			b.Logger().Info("Pending secret of the previous rotation was applied", "credentials", credsName)
+			return v3Rec, b.completeSecretRotation(ctx, s, credsName, v3Rec, overlap)
+		}
+
+		b.Logger().Info("Pending secret of the previous rotation was not applied", "credentials", credsName)
+	}
+
+	newSecret, err := randomString(generatedSecretLength, passwordCharsLower, passwordCharsUpper, passwordCharsDigits)
+	if err != nil {
+		return nil, errwrap.Wrapf("cannot generate secret: {{err}}", err)
+	}
+
+	v3Rec.PendingKeySecret = newSecret
+	if err := putAuthRecordByName(ctx, s, credsName, v3Rec); err != nil {
+		return nil, err
+	}
+
+	changeSent := false
+	err = b.withV3Api(ctx, s, v3Rec, func(api *v3Api) error {
+		if key, err := api.findPackageKey(v3Rec.ApiKey); err != nil {
+			return err
+		} else if key == nil {
+			return fmt.Errorf("package key '%s' was not found", maskSensitive(v3Rec.ApiKey))
+		} else {
+			changeSent = true
+			return api.changePackageKeySecret(key.Id, newSecret)
+		}
+	})
+	if err != nil {
+		// Mashery could have applied the change without responding; the next rotation reads which secret is in effect.
+		if changeSent && !rejectedByMashery(err) {
+			return nil, errwrap.Wrapf("outcome of the secret change is unknown; the new secret is kept as pending: {{err}}", err)
+		}
+
+		v3Rec.PendingKeySecret = ""
+		if putErr := putAuthRecordByName(ctx, s, credsName, v3Rec); putErr != nil {
+			b.Logger().Error("Could not discard pending secret", "credentials", credsName, "error", putErr)
+		}
+		return nil, errwrap.Wrapf("mashery did not change the secret: {{err}}", err)
+	}
+
+	if err := b.completeSecretRotation(ctx, s, credsName, v3Rec, overlap); err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("Rotated package key secret", "credentials", credsName, "overlap", overlap)
+	return v3Rec, nil
+}
+
+// completeSecretRotation replaces the stored secret with the pending secret, retaining the replaced secret for the
+// overlap duration.
+func (b *AuthPlugin) completeSecretRotation(ctx context.Context, s logical.Storage, credsName string, v3Rec *AuthRec, overlap time.Duration) error {
+	now := time.Now()
+	v3Rec.PreviousKeySecret = v3Rec.KeySecret
+	v3Rec.PreviousSecretValidUntil = now.Add(overlap).Unix()
+	v3Rec.KeySecret = v3Rec.PendingKeySecret
+	v3Rec.PendingKeySecret = ""
+	v3Rec.SecretRotatedAt = now.Unix()
+	return putAuthRecordVersion(ctx, s, credsName, v3Rec, versionActorPlugin, "", versionOpRotateSecret)
+}
+
+// pendingSecretApplied reads the secret of the package key from Mashery and tells whether it is the pending secret
+// of the credentials. If Mashery no longer grants the access token with the stored secret, the pending secret is
+// used to obtain it.
+func (b *AuthPlugin) pendingSecretApplied(ctx context.Context, s logical.Storage, v3Rec *AuthRec) (bool, error) {
+	var keySecret string
+	readSecret := func(api *v3Api) error {
+		if key, err := api.findPackageKey(v3Rec.ApiKey); err != nil {
+			return err
+		} else if key == nil {
+			return fmt.Errorf("package key '%s' was not found", maskSensitive(v3Rec.ApiKey))
+		} else {
+			keySecret = key.Secret
+			return nil
+		}
+	}
+
+	if err := b.withV3Api(ctx, s, v3Rec, readSecret); err != nil {
+		pendingRec := *v3Rec
+		pendingRec.KeySecret = v3Rec.PendingKeySecret
+		if pendingErr := b.withV3Api(ctx, s, &pendingRec, readSecret); pendingErr != nil {
+			return false, err
+		}
+	}
+
+	switch keySecret {
+	case v3Rec.PendingKeySecret:
+		return true, nil
+	case v3Rec.KeySecret:
+		return false, nil
+	default:
+		return false, errors.New("secret of the package key was changed outside of the plugin; write it to the credentials")
+	}
+}
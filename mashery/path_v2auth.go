@@ -2,13 +2,15 @@ package mashery
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -19,20 +21,41 @@ Mashery V2 authentication token comprises api key, Mashery are numeric id, and t
 This makes this lease non-renewable and non-revocable. The maximum technical validity of the signature is capped 
 at 5 minutes since the moment it was issued. Applications using Mashery V2 API are recommended to refresh this 
 token very minute.
+
+Specifying 'include_url=true' additionally returns the ready-to-use URL of the V2 JSON-RPC endpoint of the area
+with the apikey and sig query parameters, and the HTTP headers the request should carry. This allows calling
+the V2 API directly, e.g. with curl.
 `
 
 	secretMasheryV2Access = "v2_access"
+
+	secretPreviousSigField = "sig_previous"
+	secretIncludeUrlField  = "include_url"
+	secretV2UrlField       = "url"
+	secretV2AreaPathField  = "area_path"
+	secretV2HeadersField   = "headers"
+	secretV2TimestampField = "timestamp"
+
+	v2ApiEndpoint    = "https://api.mashery.com/v2/json-rpc"
+	v2SignatureLease = time.Minute
+	// Lightweight query used to confirm that Mashery accepts the V2 signature.
+	v2PingRequest = `{"method":"object.query","params":["SELECT id FROM members ITEMS 1"],"id":1}`
 )
 
 func pathV2Credentials(b *AuthPlugin) *framework.Path {
 	return &framework.Path{
 		Pattern: "auth/" + framework.GenericNameWithAtRegex(credentialsName) + "/v2",
-		Fields: map[string]*framework.FieldSchema{
+		Fields: handoffFieldSchemas(map[string]*framework.FieldSchema{
 			credentialsName: {
 				Type:        framework.TypeString,
 				Description: "Mashery area logical name",
 			},
-		},
+			secretIncludeUrlField: {
+				Type:        framework.TypeBool,
+				Description: "Include the ready-to-use V2 request URL and headers in the response",
+				Default:     false,
+			},
+		}),
 
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -64,13 +87,25 @@ func v2AccessSecret(b *AuthPlugin) *framework.Secret {
 				Type:        framework.TypeString,
 				Description: "Salted signed secret",
 			},
+			secretPreviousSigField: {
+				Type:        framework.TypeString,
+				Description: "Salted signed previous secret, returned within the overlap window after the secret rotation",
+			},
 			secretQpsField: {
 				Type:        framework.TypeInt,
 				Description: "Maximum QPS this key can achieve",
 			},
+			secretV2TimestampField: {
+				Type:        framework.TypeInt,
+				Description: "Timestamp the signature was salted with: Epoch seconds, or Epoch milliseconds if the credentials sign with millis",
+			},
+			secretV2UrlField: {
+				Type:        framework.TypeString,
+				Description: "V2 JSON-RPC endpoint URL of the area with apikey and sig parameters, if requested",
+			},
 		},
-		DefaultDuration: time.Minute,
-		Revoke:          b.noopRenewRevoke,
+		DefaultDuration: v2SignatureLease,
+		Revoke:          b.revokeV2Signature,
 	}
 }
 
@@ -78,7 +113,15 @@ func suppliesKeyAndSecret(v3Rec *AuthRec) bool {
 	return len(v3Rec.ApiKey) > 0 && len(v3Rec.KeySecret) > 0
 }
 
+func sufficientForV2(v3Rec *AuthRec) bool {
+	return v3Rec.AreaNid > 0 && suppliesKeyAndSecret(v3Rec)
+}
+
 func (b *AuthPlugin) pathReadV2Credentials(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if errResp := validateHandoff(d); errResp != nil {
+		return errResp, nil
+	}
+
 	if entry, err := req.Storage.Get(ctx, storagePathForMasheryArea(d)); err != nil {
 		return nil, errwrap.Wrapf("cannot read site credentials: {{err}", err)
 	} else {
@@ -87,22 +130,181 @@ func (b *AuthPlugin) pathReadV2Credentials(ctx context.Context, req *logical.Req
 			return nil, errwrap.Wrapf("cannot unmarshal V3 authorization data structure ({{err}})", err)
 		}
 
-		if v3Rec.AreaNid == 0 || !suppliesKeyAndSecret(&v3Rec) {
-			return nil, errors.New("insufficient data to generate V2 signature")
+		resp, err := b.issueV2Signature(ctx, req, &v3Rec, map[string]interface{}{
+			secretInternalSiteStoragePath: storagePathForMasheryArea(d),
+		})
+		if err == nil && !resp.IsError() && d.Get(secretIncludeUrlField).(bool) {
+			err = b.addV2RequestURL(ctx, req.Storage, &v3Rec, resp)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b.handOff(ctx, req, d, resp)
+	}
+}
+
+// v2AreaPath path of the area's V2 JSON-RPC endpoint relative to the V2 API base URL.
+func v2AreaPath(v3Rec *AuthRec) string {
+	return fmt.Sprintf("/%d", v3Rec.AreaNid)
+}
+
+// v2RequestURL URL of the area's V2 JSON-RPC endpoint carrying the api key and the signature.
+func v2RequestURL(endpoint string, v3Rec *AuthRec, sig string) string {
+	return fmt.Sprintf("%s%s?apikey=%s&sig=%s", endpoint, v2AreaPath(v3Rec), url.QueryEscape(v3Rec.ApiKey), url.QueryEscape(sig))
+}
+
+// addV2RequestURL adds the ready-to-use V2 request URL and headers to the response carrying the V2 signature.
+func (b *AuthPlugin) addV2RequestURL(ctx context.Context, s logical.Storage, v3Rec *AuthRec, resp *logical.Response) error {
+	t, err := b.transportOf(ctx, s, v3Rec)
+	if err != nil {
+		return err
+	}
+
+	resp.Data[secretV2UrlField] = v2RequestURL(t.v2Endpoint(), v3Rec, resp.Data[secretSignedSecretField].(string))
+	resp.Data[secretV2AreaPathField] = v2AreaPath(v3Rec)
+	resp.Data[secretV2HeadersField] = map[string]string{
+		"Content-Type": "application/json",
+	}
+	return nil
+}
+
+// v2SigningGrant the credentials, with the mount defaults applied, that V2 signatures are issued for, together
+// with the clock offset the signatures are salted with and the QPS allocated to the lease.
+type v2SigningGrant struct {
+	cfg    *MountConfig
+	rec    AuthRec
+	offset time.Duration
+	qps    int
+}
+
+// grantV2Signing prepares issuing V2 signatures for the credentials, allocating their QPS for the specified
+// duration, or for the V2 lease duration of the mount if zero. The allocation is recorded in the internal data.
+// The error response is returned instead of the grant if the mount does not issue V2 credentials.
+func (b *AuthPlugin) grantV2Signing(ctx context.Context, req *logical.Request, v3Rec *AuthRec, internalData map[string]interface{}, duration time.Duration) (*v2SigningGrant, *logical.Response, error) {
+	if !sufficientForV2(v3Rec) {
+		return nil, nil, errors.New("insufficient data to generate V2 signature")
+	}
+
+	cfg, err := getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, nil, err
+	} else if !cfg.allows(apiVersionV2) {
+		return nil, logical.ErrorResponse("this mount does not issue V2 credentials"), nil
+	}
+
+	retVal := &v2SigningGrant{cfg: cfg, rec: cfg.applyDefaultsTo(*v3Rec)}
+	if retVal.offset, err = b.v2ClockOffset(ctx, req.Storage, &retVal.rec); err != nil {
+		return nil, nil, err
+	}
+
+	if duration == 0 {
+		duration = cfg.v2LeaseDuration()
+	}
+	allocId, qps, err := b.allocateQPS(ctx, req.Storage, credentialsNameOfInternalData(internalData), retVal.rec.MaxQPS, duration)
+	if err != nil {
+		return nil, nil, err
+	}
+	internalData[secretInternalQpsAllocation] = allocId
+	retVal.qps = qps
+
+	return retVal, nil, nil
+}
+
+// addSignatures adds the signature for the Vault time, corrected for the clock offset, to the data. Within the
+// overlap window after the secret rotation, the signature with the previous secret is added as well.
+func (g *v2SigningGrant) addSignatures(data map[string]interface{}, t time.Time) {
+	data[secretSignedSecretField] = v2Signature(&g.rec, t.Add(g.offset))
+
+	if g.rec.previousSecretValid(t) {
+		// Consumers reaching Mashery nodes that have not yet picked up the rotated secret can fall back to this one.
+		previousRec := g.rec.withPreviousSecret()
+		data[secretPreviousSigField] = v2Signature(&previousRec, t.Add(g.offset))
+	}
+}
+
+// issueV2Signature generates V2 signature for the credentials and wraps it into the V2 access secret. The
+// internal data identifies the source of the credentials for the revocation.
+func (b *AuthPlugin) issueV2Signature(ctx context.Context, req *logical.Request, v3Rec *AuthRec, internalData map[string]interface{}) (*logical.Response, error) {
+	grant, errResp, err := b.grantV2Signing(ctx, req, v3Rec, internalData, 0)
+	if err != nil || errResp != nil {
+		return errResp, err
+	}
+
+	now := time.Now()
+	resp := b.Secret(secretMasheryV2Access).Response(map[string]interface{}{
+		secretAreaNidField:     grant.rec.AreaNid,
+		secretQpsField:         grant.qps,
+		secretApiKeField:       grant.rec.ApiKey,
+		secretV2TimestampField: v2SignerOf(&grant.rec).Timestamp(now.Add(grant.offset)),
+	}, internalData)
+	grant.addSignatures(resp.Data, now)
+	resp.Secret.TTL = grant.cfg.v2LeaseDuration()
+
+	return resp, nil
+}
+
+func (b *AuthPlugin) revokeV2Signature(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if req.Secret != nil && req.Secret.InternalData != nil {
+		if err := b.releaseQPS(ctx, req.Storage, req.Secret.InternalData); err != nil {
+			b.Logger().Error("Error releasing QPS allocation of V2 signature", "error", err)
 		}
+	}
+
+	// V2 signature cannot be revoked and expires by itself.
+	return nil, nil
+}
+
+// v2Signature computes V2 signature of the key and secret salted with the specified time, using the signer
+// selected for the credentials.
+func v2Signature(v3Rec *AuthRec, t time.Time) string {
+	return v2SignerOf(v3Rec).Sign(v3Rec.ApiKey, v3Rec.KeySecret, t)
+}
+
+type v2RpcResponse struct {
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// pingV2 sends a lightweight query to Mashery V2 API to confirm that the V2 signature generated from these
+// credentials is accepted.
+func (b *AuthPlugin) pingV2(ctx context.Context, s logical.Storage, v3Rec *AuthRec) error {
+	cl, t, err := b.httpClientOf(ctx, s, v3Rec)
+	if err != nil {
+		return err
+	}
+	offset, err := b.v2ClockOffset(ctx, s, v3Rec)
+	if err != nil {
+		return err
+	}
 
-		now := time.Now().Unix()
+	resp, err := doWithRetry(ctx, cl, t, func() (*http.Request, error) {
+		// The signature is re-computed for each attempt as it is salted with the current time.
+		endpoint := v2RequestURL(t.v2Endpoint(), v3Rec, v2Signature(v3Rec, time.Now().Add(offset)))
 
-		hash := md5.New()
-		hash.Write([]byte(fmt.Sprintf("%s%s%d", v3Rec.ApiKey, v3Rec.KeySecret, now)))
+		req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(v2PingRequest))
+		if err != nil {
+			return nil, errwrap.Wrapf("cannot create V2 request: {{err}}", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return errwrap.Wrapf("V2 API call failed: {{err}}", err)
+	}
+	defer resp.Body.Close()
 
-		resp := b.Secret(secretMasheryV2Access).Response(map[string]interface{}{
-			secretAreaNidField:      v3Rec.AreaNid,
-			secretQpsField:          v3Rec.MaxQPS,
-			secretApiKeField:        v3Rec.ApiKey,
-			secretSignedSecretField: hex.EncodeToString(hash.Sum(nil)),
-		}, map[string]interface{}{})
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("V2 API returned unexpected status code %d", resp.StatusCode)
+	}
 
-		return resp, nil
+	rpcResp := v2RpcResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return errwrap.Wrapf("cannot unmarshal V2 API response: {{err}}", err)
+	} else if rpcResp.Error != nil {
+		return fmt.Errorf("V2 API returned error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
 	}
+
+	return nil
 }
@@ -0,0 +1,153 @@
+package mashery
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const (
+	scheduleCountField      = "count"
+	scheduleIntervalField   = "interval"
+	scheduleSignaturesField = "signatures"
+	scheduleValidFromField  = "valid_from"
+	scheduleValidUntilField = "valid_until"
+
+	defaultScheduleCount    = 60
+	defaultScheduleInterval = 60
+	minScheduleInterval     = 10
+	// Mashery accepts V2 signature for about 5 minutes; longer slots would outlive their signature.
+	maxScheduleInterval = 5 * 60
+	maxScheduleHorizon  = 12 * time.Hour
+
+	secretMasheryV2Schedule = "v2_schedule"
+
+	pathV2ScheduleHelpSyn  = "Retrieves a schedule of Mashery V2 API signatures"
+	pathV2ScheduleHelpDesc = `
+Returns a series of V2 signatures for consecutive future time slots under a single lease. Each signature is tagged
+with the time window (valid_from, valid_until; Epoch seconds) in which the consumer should use it. This allows
+long-running batch jobs to read the signatures once instead of reading auth/<credentialsName>/v2 every minute.
+Slots starting within the overlap window after the secret rotation additionally carry the signature with the
+previous secret as 'sig_previous'.
+
+The number of slots (count) and the slot duration (interval) are bounded such that the schedule does not extend
+beyond 12 hours. The lease lasts until the end of the last slot.`
+)
+
+func pathV2Schedule(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "auth/" + framework.GenericNameWithAtRegex(credentialsName) + "/v2/schedule",
+		Fields: map[string]*framework.FieldSchema{
+			credentialsName: {
+				Type:        framework.TypeString,
+				Description: "Mashery area logical name",
+			},
+			scheduleCountField: {
+				Type:        framework.TypeInt,
+				Description: fmt.Sprintf("Number of time slots. Defaults to %d", defaultScheduleCount),
+				Default:     defaultScheduleCount,
+			},
+			scheduleIntervalField: {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("Duration of each time slot, between %d and %d seconds. Defaults to %d seconds", minScheduleInterval, maxScheduleInterval, defaultScheduleInterval),
+				Default:     defaultScheduleInterval,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathReadV2Schedule,
+				Summary:  "Retrieve V2 signatures for future time slots",
+			},
+		},
+
+		ExistenceCheck: b.siteExistenceCheck,
+
+		HelpSynopsis:    pathV2ScheduleHelpSyn,
+		HelpDescription: pathV2ScheduleHelpDesc,
+	}
+}
+
+func v2ScheduleSecret(b *AuthPlugin) *framework.Secret {
+	return &framework.Secret{
+		Type: secretMasheryV2Schedule,
+		Fields: map[string]*framework.FieldSchema{
+			secretAreaNidField: {
+				Type:        framework.TypeInt,
+				Description: "Mashery Area Numeric Id",
+			},
+			secretApiKeField: {
+				Type:        framework.TypeString,
+				Description: "Mashery V2 API Key",
+			},
+			secretQpsField: {
+				Type:        framework.TypeInt,
+				Description: "Maximum QPS this key can achieve",
+			},
+			scheduleSignaturesField: {
+				Type:        framework.TypeSlice,
+				Description: "Signatures with the time windows these should be used in",
+			},
+		},
+		DefaultDuration: time.Hour,
+		Revoke:          b.revokeV2Signature,
+	}
+}
+
+func (b *AuthPlugin) pathReadV2Schedule(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	count := d.Get(scheduleCountField).(int)
+	interval := d.Get(scheduleIntervalField).(int)
+
+	if count <= 0 {
+		return logical.ErrorResponse("count must be positive"), nil
+	} else if interval < minScheduleInterval || interval > maxScheduleInterval {
+		return logical.ErrorResponse("interval must be between %d and %d seconds", minScheduleInterval, maxScheduleInterval), nil
+	}
+
+	slot := time.Second * time.Duration(interval)
+	horizon := slot * time.Duration(count)
+	if horizon > maxScheduleHorizon {
+		return logical.ErrorResponse("schedule of %d slots of %s exceeds maximum horizon of %s", count, slot, maxScheduleHorizon), nil
+	}
+
+	v3Rec, err := getAuthRecord(ctx, req, d)
+	if err != nil {
+		return nil, err
+	} else if v3Rec == nil {
+		return logical.ErrorResponse("no credentials stored under this name"), nil
+	}
+
+	internalData := map[string]interface{}{
+		secretInternalSiteStoragePath: storagePathForMasheryArea(d),
+	}
+	grant, errResp, err := b.grantV2Signing(ctx, req, v3Rec, internalData, horizon)
+	if err != nil || errResp != nil {
+		return errResp, err
+	}
+
+	// Slots are expressed in Vault time; signatures are salted with the time corrected for the clock skew. Slots
+	// starting within the overlap window after the secret rotation carry the signature with the previous secret.
+	start := time.Now()
+	signatures := make([]map[string]interface{}, count)
+	for i := range signatures {
+		validFrom := start.Add(slot * time.Duration(i))
+		signatures[i] = map[string]interface{}{
+			scheduleValidFromField:  validFrom.Unix(),
+			scheduleValidUntilField: validFrom.Add(slot).Unix(),
+		}
+		grant.addSignatures(signatures[i], validFrom)
+	}
+
+	resp := b.Secret(secretMasheryV2Schedule).Response(map[string]interface{}{
+		secretAreaNidField:      grant.rec.AreaNid,
+		secretQpsField:          grant.qps,
+		secretApiKeField:        grant.rec.ApiKey,
+		scheduleSignaturesField: signatures,
+	}, internalData)
+	resp.Secret.TTL = horizon
+
+	b.Logger().Info("Issued V2 signature schedule", "count", count, "interval", slot)
+	return resp, nil
+}
@@ -34,6 +34,9 @@ revoked.
 
 The lease duration of the provided access token can be changed either by extending the lease
 up to the duration of the access token validity, or specifying a custom lease duration for this site.
+A renewal requested within 2 minutes before the access token expires will exchange the refresh token for a new
+access token, which is returned in the renewal response. This allows renewing the lease beyond the 1 hour life
+time of the original token; the client should switch to the new access token upon such renewal.
 `
 
 	secretMasheryV3Access = "v3_access"
@@ -61,12 +64,12 @@ func v3AccessSecret(b *AuthPlugin) *framework.Secret {
 func pathV3Credentials(b *AuthPlugin) *framework.Path {
 	return &framework.Path{
 		Pattern: "auth/" + framework.GenericNameWithAtRegex(credentialsName) + "/v3",
-		Fields: map[string]*framework.FieldSchema{
+		Fields: handoffFieldSchemas(map[string]*framework.FieldSchema{
 			credentialsName: {
 				Type:        framework.TypeString,
 				Description: "Mashery area logical name",
 			},
-		},
+		}),
 
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -96,55 +99,134 @@ func min(x, y int) int {
 	}
 }
 
-func max(x, y time.Duration) time.Duration {
-	if x > y {
-		return x
-	} else {
-		return y
+func (b *AuthPlugin) pathReadV3Credentials(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if errResp := validateHandoff(d); errResp != nil {
+		return errResp, nil
 	}
-}
 
-func (b *AuthPlugin) pathReadV3Credentials(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	if v3Rec, err := getAuthRecord(ctx, req, d); err != nil {
 		return nil, errwrap.Wrapf("cannot read site credentials: {{err}", err)
-	} else if v3Rec == nil {
+	} else {
+		resp, err := b.issueV3AccessToken(ctx, req, v3Rec, map[string]interface{}{
+			secretInternalSiteStoragePath: storagePathForMasheryArea(d),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return b.handOff(ctx, req, d, resp)
+	}
+}
+
+// issueV3AccessToken obtains V3 access token for the credentials and wraps it into the V3 access secret. The
+// internal data identifies the source of the credentials for the renewal and revocation.
+func (b *AuthPlugin) issueV3AccessToken(ctx context.Context, req *logical.Request, v3Rec *AuthRec, internalData map[string]interface{}) (*logical.Response, error) {
+	if v3Rec == nil {
 		return nil, errors.New("nil authorization data structure returned")
 	} else if !sufficientForV3(v3Rec) {
 		return nil, errors.New("site data is not sufficient to request v3 access token")
 	} else {
+		cfg, err := getMountConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		} else if !cfg.allows(apiVersionV3) {
+			return logical.ErrorResponse("this mount does not issue V3 credentials"), nil
+		}
+
+		effectiveRec := cfg.applyDefaultsTo(*v3Rec)
+		v3Rec = &effectiveRec
+
+		credsName := credentialsNameOfInternalData(internalData)
+		allocId, qps, err := b.allocateQPS(ctx, req.Storage, credsName, v3Rec.MaxQPS, time.Second*time.Duration(v3Rec.LeaseDuration))
+		if err != nil {
+			return nil, err
+		}
+		internalData[secretInternalQpsAllocation] = allocId
+
+		grantRec := *v3Rec
+		grantRec.MaxQPS = qps
+
 		// We have site data and site dat is sufficient to produce credentials.
 		v3Credentials := v3Rec.asV3Credentials()
-		if tkn, err := b.v3OauthHelper.RetrieveAccessTokenFor(&v3Credentials); err != nil {
+		helper, err := b.oauthHelperOf(ctx, req.Storage, v3Rec)
+		if err != nil {
+			if relErr := b.releaseQPS(ctx, req.Storage, internalData); relErr != nil {
+				b.Logger().Error("Error releasing QPS allocation", "credentials", credsName, "error", relErr)
+			}
+			return nil, err
+		}
+
+		if v3Rec.CacheToken {
+			if id, tkn, err := b.acquireCachedV3Token(ctx, req.Storage, helper, credsName, v3Rec); err != nil {
+				if relErr := b.releaseQPS(ctx, req.Storage, internalData); relErr != nil {
+					b.Logger().Error("Error releasing QPS allocation", "credentials", credsName, "error", relErr)
+				}
+				return nil, err
+			} else {
+				internalData[secretInternalCachedTokenId] = id
+				return b.createSecretResponse(tkn, &grantRec, cfg.v3MaxTTL(), internalData), nil
+			}
+		} else if tkn, err := b.retrieveAccessToken(helper, v3Rec, &v3Credentials); err != nil {
+			if relErr := b.releaseQPS(ctx, req.Storage, internalData); relErr != nil {
+				b.Logger().Error("Error releasing QPS allocation", "credentials", credsName, "error", relErr)
+			}
 			return nil, errwrap.Wrapf("access token was not granted: {{err}", err)
 		} else {
-			return b.createSecretResponse(tkn, v3Rec, d), nil
+			return b.createSecretResponse(tkn, &grantRec, cfg.v3MaxTTL(), internalData), nil
 		}
 	}
 }
 
-func (b *AuthPlugin) createSecretResponse(tkn *v3client.TimedAccessTokenResponse, v3Rec *AuthRec, d *framework.FieldData) *logical.Response {
+// retrieveAccessToken obtains the access token for the credentials. Within the overlap window after the key secret
+// rotation, the previous key secret is tried if Mashery does not grant the token with the current one.
+func (b *AuthPlugin) retrieveAccessToken(helper oauthHelper, v3Rec *AuthRec, v3Credentials *v3client.MasheryV3Credentials) (*v3client.TimedAccessTokenResponse, error) {
+	tkn, err := helper.RetrieveAccessTokenFor(v3Credentials)
+	if err != nil && v3Rec.previousSecretValid(time.Now()) {
+		b.Logger().Warn("Access token was not granted with the current key secret; trying the previous one", "error", err)
+
+		previousCredentials := v3Rec.withPreviousSecret().asV3Credentials()
+		if prevTkn, prevErr := helper.RetrieveAccessTokenFor(&previousCredentials); prevErr == nil {
+			*v3Credentials = previousCredentials
+			return prevTkn, nil
+		}
+	}
+
+	return tkn, err
+}
+
+// v3MaxTTLOf maximum duration of the V3 lease, counting the renewals: that of the role the lease was issued for, or
+// that of the mount.
+func v3MaxTTLOf(cfg *MountConfig, role *RoleRec) time.Duration {
+	if role != nil && role.MaxTTL > 0 {
+		return time.Second * time.Duration(role.MaxTTL)
+	}
+	return cfg.v3MaxTTL()
+}
+
+func (b *AuthPlugin) createSecretResponse(tkn *v3client.TimedAccessTokenResponse, v3Rec *AuthRec, maxTTL time.Duration, internalData map[string]interface{}) *logical.Response {
 	exp := time.Now().Add(time.Second * time.Duration(tkn.ExpiresIn))
 
 	b.Logger().Info("Maximum token expiry time", "exp", exp.Unix())
 
+	// Cached tokens are refreshed through the cache; their leases do not bear the shared refresh token.
+	if len(tkn.RefreshToken) > 0 {
+		internalData[secretInternalRefreshToken] = tkn.RefreshToken
+	}
+	internalData[secretInternalTokenExpiryTime] = exp.Unix()
+
 	response := b.Secret(secretMasheryV3Access).Response(map[string]interface{}{
 		secretAccessToken: tkn.AccessToken,
 		secretQpsField:    v3Rec.MaxQPS,
-	}, map[string]interface{}{
-		secretInternalSiteStoragePath: storagePathForMasheryArea(d),
-		secretInternalRefreshToken:    tkn.RefreshToken,
-		secretInternalTokenExpiryTime: exp.Unix(),
-	})
+	}, internalData)
 
 	usableTokenTime := min(v3Rec.LeaseDuration, tkn.ExpiresIn)
 	b.Logger().Info(fmt.Sprintf("Usable token time in seconds: %d, chosen from %d lead duration and %d exipry time", usableTokenTime, v3Rec.LeaseDuration, tkn.ExpiresIn))
 
-	response.Secret.LeaseOptions.TTL = time.Second * time.Duration(usableTokenTime)
-	response.Secret.LeaseOptions.MaxTTL = max(time.Hour*1, time.Second*time.Duration(usableTokenTime))
+	// The lease is not capped at the life time of the token, as the renewal can refresh the token. The maximum TTL
+	// is that of the mount, or of the role the lease was issued for.
+	response.Secret.LeaseOptions.MaxTTL = maxTTL
+	response.Secret.LeaseOptions.TTL = capToMaxTTL(maxTTL, time.Now(), time.Second*time.Duration(usableTokenTime))
 
 	b.Logger().Info(fmt.Sprintf("Response TTL %s", response.Secret.LeaseOptions.TTL))
-	b.Logger().Info(fmt.Sprintf("Response Max TTL %s", response.Secret.LeaseOptions.MaxTTL))
-	// Hard-coded limit
 	return response
 }
 
@@ -180,7 +262,7 @@ func (b *AuthPlugin) extendV3AccessTokenLease(ctx context.Context, req *logical.
 	b.Logger().Info("Fetched V3 record", "data", v3Rec, "error", fetchErr)
 
 	var remainingTokenTime = 0
-	var maxAllowedLease = 3600
+	var maxAllowedLease = maxV3TokenLife
 
 	expRaw := req.Secret.InternalData[secretInternalTokenExpiryTime]
 	b.Logger().Info("Expiry time raw", "raw", expRaw, "type", reflect.TypeOf(expRaw).String())
@@ -189,38 +271,147 @@ func (b *AuthPlugin) extendV3AccessTokenLease(ctx context.Context, req *logical.
 		remainingTokenTime = int(int64(expConv) - time.Now().Unix())
 	}
 
-	b.Logger().Info("Remaining token time", "token", remainingTokenTime)
-	if remainingTokenTime <= 0 {
-		return nil, errors.New("lease cannot be renews as token has expired")
-	} else if remainingTokenTime <= 15 {
-		//
-		return nil, errors.New("lease almost expired, request new one instead")
+	role, err := b.roleOfSecret(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	} else if v3Rec != nil {
+		effectiveRec := *v3Rec
+		if role != nil {
+			effectiveRec = role.applyTo(effectiveRec)
+		}
+		effectiveRec = cfg.applyDefaultsTo(effectiveRec)
+		if effectiveRec.LeaseDuration > 0 {
+			maxAllowedLease = effectiveRec.LeaseDuration
+		}
 	}
 
-	if v3Rec != nil && v3Rec.LeaseDuration > 0 {
-		maxAllowedLease = v3Rec.LeaseDuration
+	// The lease is checked against its maximum TTL and its QPS allocation before the token is refreshed, as
+	// refreshing invalidates the access token the client holds.
+	allowedTTL := capToMaxTTL(v3MaxTTLOf(cfg, role), req.Secret.IssueTime, time.Duration(maxAllowedLease)*time.Second)
+	if allowedTTL <= 0 {
+		return nil, errors.New("lease cannot be renewed beyond its maximum TTL")
+	}
+
+	if err := b.extendQPS(ctx, req.Storage, req.Secret.InternalData, allowedTTL); err != nil {
+		return nil, errwrap.Wrapf("cannot extend QPS allocation: {{err}}", err)
+	}
+
+	// The cached token could have been refreshed since the lease was issued or last renewed. The token that was
+	// handed off is not refreshed, as the consumer holding it would not receive the new one.
+	renewedAccessToken := ""
+	refreshed := false
+	handedOff, _ := req.Secret.InternalData[secretInternalHandedOff].(bool)
+	if handedOff {
+		b.Logger().Info("Access token of the lease was handed off and is not refreshed")
+	} else if cachedTkn, err := b.cachedTokenOfSecret(ctx, req, v3Rec); err != nil {
+		return nil, err
+	} else if cachedTkn != nil {
+		remainingTokenTime = cachedTkn.remainingTime(time.Now())
+		renewedAccessToken = cachedTkn.AccessToken
+		req.Secret.InternalData[secretInternalTokenExpiryTime] = cachedTkn.ExpiryTime
+	} else if remainingTokenTime <= v3RefreshAheadTime && v3Rec != nil && suppliesKeyAndSecret(v3Rec) {
+		// The token of the lease is about to expire; it is exchanged for the new one which is returned to the client.
+		if tkn, err := b.refreshAccessTokenOfSecret(ctx, req, v3Rec); err != nil {
+			b.Logger().Warn("Access token of the lease was not refreshed", "error", err)
+		} else {
+			remainingTokenTime = tkn.ExpiresIn
+			renewedAccessToken = tkn.AccessToken
+			refreshed = true
+		}
+	}
+
+	b.Logger().Info("Remaining token time", "token", remainingTokenTime)
+	if remainingTokenTime <= 15 {
+		if refreshed {
+			// The token the client held was invalidated by the refresh; the lease is of no use anymore.
+			if _, err := b.revokeV3AccessToken(ctx, req, d); err != nil {
+				b.Logger().Error("Could not revoke refreshed access token of the lease", "error", err)
+			}
+		}
+
+		if remainingTokenTime <= 0 {
+			return nil, errors.New("lease cannot be renews as token has expired")
+		}
+		return nil, errors.New("lease almost expired, request new one instead")
 	}
 
 	usableTokenTime := min(remainingTokenTime, maxAllowedLease)
 	b.Logger().Info(fmt.Sprintf("Usable token time in seconds: %d, chosen from %d seconds lead duration and remaining %d seconds exipry time", usableTokenTime, maxAllowedLease, remainingTokenTime))
 
 	resp := &logical.Response{Secret: req.Secret}
+	if len(renewedAccessToken) > 0 {
+		// The refreshed token replaces the one in the data of the lease; the other fields are kept.
+		resp.Data = make(map[string]interface{}, len(req.Data)+1)
+		for k, v := range req.Data {
+			resp.Data[k] = v
+		}
+		resp.Data[secretAccessToken] = renewedAccessToken
+	}
+
 	resp.Secret.TTL = time.Duration(usableTokenTime) * time.Second
+	if resp.Secret.TTL > allowedTTL {
+		resp.Secret.TTL = allowedTTL
+	}
 
 	return resp, nil
 }
 
+// refreshAccessTokenOfSecret exchanges the refresh token of the lease for a new access token, and records the new
+// refresh token and expiry time in the lease's internal data.
+func (b *AuthPlugin) refreshAccessTokenOfSecret(ctx context.Context, req *logical.Request, v3Rec *AuthRec) (*v3client.TimedAccessTokenResponse, error) {
+	refreshToken, ok := req.Secret.InternalData[secretInternalRefreshToken].(string)
+	if !ok || len(refreshToken) == 0 {
+		return nil, errors.New("lease does not bear refresh token")
+	}
+
+	helper, err := b.oauthHelperOf(ctx, req.Storage, v3Rec)
+	if err != nil {
+		return nil, err
+	}
+
+	v3Credentials := v3Rec.asV3Credentials()
+	tkn, err := helper.ExchangeRefreshToken(&v3Credentials, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := time.Now().Add(time.Second * time.Duration(tkn.ExpiresIn))
+	req.Secret.InternalData[secretInternalRefreshToken] = tkn.RefreshToken
+	req.Secret.InternalData[secretInternalTokenExpiryTime] = exp.Unix()
+
+	b.Logger().Info("Refreshed access token of the lease", "exp", exp.Unix())
+	return tkn, nil
+}
+
 func (b *AuthPlugin) revokeV3AccessToken(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	if v3Rec, err := b.getAuthRecordOfSecret(ctx, req); err != nil {
 		return nil, errwrap.Wrapf("error in retrieving v3 authentication record: {{err}}", err)
-	} else if v3Rec != nil && suppliesKeyAndSecret(v3Rec) {
+	} else if cachedId, ok := req.Secret.InternalData[secretInternalCachedTokenId].(string); ok && len(cachedId) > 0 {
+		// The cached token is shared with other leases and is invalidated only when no longer referred to.
+		credsName := credentialsNameOfInternalData(req.Secret.InternalData)
+		if err = b.releaseCachedV3Token(ctx, req.Storage, credsName, cachedId, v3Rec); err != nil {
+			b.Logger().Error("Error releasing cached access token", "error", err)
+		}
+	} else if refreshToken, ok := req.Secret.InternalData[secretInternalRefreshToken].(string); ok && len(refreshToken) > 0 &&
+		v3Rec != nil && suppliesKeyAndSecret(v3Rec) {
 		v3Credentials := v3Rec.asV3Credentials()
 		// An attempt is made to invoke the refresh token, which will invalidate the current access token.
-		if _, err = b.v3OauthHelper.ExchangeRefreshToken(&v3Credentials, req.Secret.InternalData[secretInternalRefreshToken].(string)); err != nil {
+		if helper, err := b.oauthHelperOf(ctx, req.Storage, v3Rec); err != nil {
+			b.Logger().Error("Cannot create OAuth helper to invalidate access token", "error", err)
+		} else if _, err = helper.ExchangeRefreshToken(&v3Credentials, refreshToken); err != nil {
 			b.Logger().Error("Error returned while trying to invoke an exchange token", "error", err)
 		}
 	}
 
+	if err := b.releaseQPS(ctx, req.Storage, req.Secret.InternalData); err != nil {
+		b.Logger().Error("Error releasing QPS allocation of V3 access token", "error", err)
+	}
+
 	// Access token cannot be revoked forcibly and should expire by itself.
 	return nil, nil
 }
@@ -0,0 +1,143 @@
+package mashery
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+)
+
+const (
+	secretVerifyField       = "verify"
+	secretV2VerifiedField   = "v2_verified"
+	secretV3VerifiedField   = "v3_verified"
+	secretVerifyErrorsField = "errors"
+
+	pathAreaVerifyHelpSyn  = "Verifies stored Mashery credentials"
+	pathAreaVerifyHelpDesc = `
+Verifies that the stored Mashery credentials are accepted by Mashery. If the credentials are sufficient for the
+V3 API, the plugin will obtain an access token and will immediately invalidate it. If the credentials are sufficient
+for the V2 API, the plugin will perform a lightweight V2 query signed with these credentials. The response
+indicates which API versions were verified, and which errors were encountered.
+
+The same verification can be performed while writing credentials by specifying 'verify=true'. In this case, the
+credentials that fail verification will not be saved.`
+)
+
+func pathAreaVerify(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials/" + framework.GenericNameWithAtRegex(credentialsName) + "/verify",
+		Fields: map[string]*framework.FieldSchema{
+			credentialsName: {
+				Type:        framework.TypeString,
+				Description: "Mashery Area logical name",
+				DisplayName: "Area's logical name",
+			},
+		},
+
+		ExistenceCheck: b.siteExistenceCheck,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleVerifyAreaData,
+				Summary:  "Verify stored Mashery area authentication data",
+			},
+		},
+		HelpSynopsis:    pathAreaVerifyHelpSyn,
+		HelpDescription: pathAreaVerifyHelpDesc,
+	}
+}
+
+// credentialsVerification outcome of verifying credentials against Mashery.
+type credentialsVerification struct {
+	V2Checked bool
+	V2Valid   bool
+	V3Checked bool
+	V3Valid   bool
+	Errors    []string
+}
+
+func (cv credentialsVerification) failed() bool {
+	return len(cv.Errors) > 0
+}
+
+func (cv credentialsVerification) checked() bool {
+	return cv.V2Checked || cv.V3Checked
+}
+
+// verifyAuthRecord verifies each API version the credentials are sufficient for.
+func (b *AuthPlugin) verifyAuthRecord(ctx context.Context, s logical.Storage, v3Rec *AuthRec) credentialsVerification {
+	retVal := credentialsVerification{}
+
+	if sufficientForV3(v3Rec) {
+		retVal.V3Checked = true
+
+		v3Credentials := v3Rec.asV3Credentials()
+		if helper, err := b.oauthHelperOf(ctx, s, v3Rec); err != nil {
+			retVal.Errors = append(retVal.Errors, fmt.Sprintf("v3 transport is misconfigured: %s", err))
+		} else if tkn, err := helper.RetrieveAccessTokenFor(&v3Credentials); err != nil {
+			retVal.Errors = append(retVal.Errors, fmt.Sprintf("v3 access token was not granted: %s", err))
+		} else {
+			retVal.V3Valid = true
+
+			// The token was required only for verification and is invalidated immediately.
+			if _, err = helper.ExchangeRefreshToken(&v3Credentials, tkn.RefreshToken); err != nil {
+				b.Logger().Warn("Could not invalidate the access token obtained for verification", "error", err)
+			}
+		}
+	}
+
+	if sufficientForV2(v3Rec) {
+		retVal.V2Checked = true
+
+		if err := b.pingV2(ctx, s, v3Rec); err != nil {
+			retVal.Errors = append(retVal.Errors, fmt.Sprintf("v2 signature was not accepted: %s", err))
+		} else {
+			retVal.V2Valid = true
+		}
+	}
+
+	return retVal
+}
+
+// verifyBeforePersist verifies the credentials if this was requested in the write operation. A non-nil response
+// is returned if the credentials must not be saved.
+func (b *AuthPlugin) verifyBeforePersist(ctx context.Context, s logical.Storage, data *framework.FieldData, v3Rec *AuthRec) (*logical.Response, []string) {
+	if verify, ok := data.GetOk(secretVerifyField); !ok || !verify.(bool) {
+		return nil, nil
+	}
+
+	cv := b.verifyAuthRecord(ctx, s, v3Rec)
+	if cv.failed() {
+		return logical.ErrorResponse("credentials failed verification: %s", strings.Join(cv.Errors, "; ")), nil
+	} else if !cv.checked() {
+		return nil, []string{"credentials are not sufficient for either V2 or V3 API and were not verified"}
+	}
+
+	return nil, nil
+}
+
+func (b *AuthPlugin) handleVerifyAreaData(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if v3Rec, err := getAuthRecord(ctx, req, data); err != nil {
+		return nil, err
+	} else if v3Rec == nil {
+		return logical.ErrorResponse("no credentials stored under this name"), nil
+	} else {
+		cv := b.verifyAuthRecord(ctx, req.Storage, v3Rec)
+
+		resp := &logical.Response{
+			Data: map[string]interface{}{
+				secretV2VerifiedField:   cv.V2Valid,
+				secretV3VerifiedField:   cv.V3Valid,
+				secretVerifyErrorsField: cv.Errors,
+			},
+		}
+
+		if !cv.checked() {
+			resp.AddWarning("credentials are not sufficient for either V2 or V3 API")
+		}
+
+		return resp, nil
+	}
+}
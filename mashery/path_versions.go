@@ -0,0 +1,277 @@
+package mashery
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+// Credentials history keeps the last versions of the stored credentials, including the current one, so that
+// the credentials can be restored after an update that broke them. Each version records when, by whom, and by which
+// operation it was written. Deleting the credentials is recorded as a version without the credentials; the history
+// is retained, so that the deleted credentials can be restored.
+
+const (
+	historyStoragePrefix = "history/"
+
+	maxCredentialsVersions = 10
+
+	versionField          = "version"
+	versionCreatedField   = "created_time"
+	versionCreatedByField = "created_by"
+	versionEntityIdField  = "entity_id"
+	versionOperationField = "operation"
+	versionCurrentField   = "current"
+	versionsField         = "versions"
+
+	// Actor recorded for the changes the plugin makes by itself, e.g. scheduled rotations.
+	versionActorPlugin = "plugin"
+
+	versionOpWrite          = "write"
+	versionOpRollback       = "rollback"
+	versionOpRotatePassword = "rotate-password"
+	versionOpRotateSecret   = "rotate-secret"
+	versionOpDelete         = "delete"
+
+	pathAreaVersionsHelpSyn  = "Lists versions of the stored Mashery credentials"
+	pathAreaVersionsHelpDesc = `
+Lists the versions of the stored credentials, newest first. The plugin keeps the last 10 versions. Each version
+records the time it was written, the display name and the entity id of the requester, and the operation that wrote
+it. Sensitive fields are returned masked.`
+
+	pathAreaRollbackHelpSyn  = "Restores a previous version of the stored Mashery credentials"
+	pathAreaRollbackHelpDesc = `
+Restores the specified version of the credentials. The restored credentials are saved as a new version, so that
+the rollback itself can be rolled back. Deleted credentials are restored in the same way, as the history of the
+credentials is retained after the delete. Rollback does not change anything in Mashery: if the password or the key
+secret was rotated since the restored version was written, the restored values may no longer be accepted. Rollback
+is refused while the password or the key secret rotation is pending; rotating it again settles the pending value.`
+)
+
+type credentialsVersion struct {
+	Version     int     `json:"version"`
+	CreatedTime int64   `json:"created_time"`
+	CreatedBy   string  `json:"created_by"`
+	EntityId    string  `json:"entity_id,omitempty"`
+	Operation   string  `json:"operation"`
+	Record      AuthRec `json:"record"`
+}
+
+type credentialsHistory struct {
+	Versions []credentialsVersion `json:"versions"`
+}
+
+func (h *credentialsHistory) find(version int) *credentialsVersion {
+	for i := range h.Versions {
+		if h.Versions[i].Version == version {
+			return &h.Versions[i]
+		}
+	}
+	return nil
+}
+
+func (h *credentialsHistory) latest() int {
+	if len(h.Versions) == 0 {
+		return 0
+	}
+	return h.Versions[len(h.Versions)-1].Version
+}
+
+func pathAreaVersions(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials/" + framework.GenericNameWithAtRegex(credentialsName) + "/versions",
+		Fields: map[string]*framework.FieldSchema{
+			credentialsName: {
+				Type:        framework.TypeString,
+				Description: "Mashery Area logical name",
+				DisplayName: "Area's logical name",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleReadVersions,
+				Summary:  "List versions of the stored credentials",
+			},
+		},
+		HelpSynopsis:    pathAreaVersionsHelpSyn,
+		HelpDescription: pathAreaVersionsHelpDesc,
+	}
+}
+
+func pathAreaRollback(b *AuthPlugin) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials/" + framework.GenericNameWithAtRegex(credentialsName) + "/rollback",
+		Fields: map[string]*framework.FieldSchema{
+			credentialsName: {
+				Type:        framework.TypeString,
+				Description: "Mashery Area logical name",
+				DisplayName: "Area's logical name",
+			},
+			versionField: {
+				Type:        framework.TypeInt,
+				Description: "Version of the credentials to restore",
+				DisplayName: "Version",
+				Required:    true,
+			},
+		},
+
+		ExistenceCheck: b.siteExistenceCheck,
+
+		// Rollback of the deleted credentials is a create operation.
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.handleRollback,
+				Summary:  "Restore a previous version of the deleted credentials",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleRollback,
+				Summary:  "Restore a previous version of the credentials",
+			},
+		},
+		HelpSynopsis:    pathAreaRollbackHelpSyn,
+		HelpDescription: pathAreaRollbackHelpDesc,
+	}
+}
+
+func storagePathForHistory(credsName string) string {
+	return historyStoragePrefix + credsName
+}
+
+func getCredentialsHistory(ctx context.Context, s logical.Storage, credsName string) (*credentialsHistory, error) {
+	retVal := credentialsHistory{}
+
+	if entry, err := s.Get(ctx, storagePathForHistory(credsName)); err != nil {
+		return nil, err
+	} else if entry != nil {
+		if err := entry.DecodeJSON(&retVal); err != nil {
+			return nil, errwrap.Wrapf("cannot unmarshal credentials history ({{err}})", err)
+		}
+	}
+
+	return &retVal, nil
+}
+
+// putAuthRecordVersion saves the credentials and appends them to the history as a new version.
+func putAuthRecordVersion(ctx context.Context, s logical.Storage, credsName string, v3Rec *AuthRec, actor string, entityId string, operation string) error {
+	if err := putAuthRecordByName(ctx, s, credsName, v3Rec); err != nil {
+		return err
+	}
+
+	return appendCredentialsVersion(ctx, s, credsName, v3Rec, actor, entityId, operation)
+}
+
+// appendCredentialsVersion appends the credentials to the history as a new version. The oldest versions are dropped
+// once the history grows beyond the maximum number of versions.
+func appendCredentialsVersion(ctx context.Context, s logical.Storage, credsName string, v3Rec *AuthRec, actor string, entityId string, operation string) error {
+	h, err := getCredentialsHistory(ctx, s, credsName)
+	if err != nil {
+		return err
+	}
+
+	h.Versions = append(h.Versions, credentialsVersion{
+		Version:     h.latest() + 1,
+		CreatedTime: time.Now().Unix(),
+		CreatedBy:   actor,
+		EntityId:    entityId,
+		Operation:   operation,
+		Record:      *v3Rec,
+	})
+	if len(h.Versions) > maxCredentialsVersions {
+		h.Versions = h.Versions[len(h.Versions)-maxCredentialsVersions:]
+	}
+
+	if se, err := logical.StorageEntryJSON(storagePathForHistory(credsName), h); err != nil {
+		return errwrap.Wrapf("failed to save credentials history: {{err}}", err)
+	} else {
+		return s.Put(ctx, se)
+	}
+}
+
+func (b *AuthPlugin) handleReadVersions(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	h, err := getCredentialsHistory(ctx, req.Storage, data.Get(credentialsName).(string))
+	if err != nil {
+		return nil, err
+	} else if len(h.Versions) == 0 {
+		return nil, nil
+	}
+
+	var versions []map[string]interface{}
+	for i := len(h.Versions) - 1; i >= 0; i-- {
+		v := h.Versions[i]
+		versions = append(versions, map[string]interface{}{
+			versionField:             v.Version,
+			versionCreatedField:      v.CreatedTime,
+			versionCreatedByField:    v.CreatedBy,
+			versionEntityIdField:     v.EntityId,
+			versionOperationField:    v.Operation,
+			versionCurrentField:      v.Version == h.latest(),
+			secretAreaIdField:        v.Record.AreaId,
+			secretAreaNidField:       v.Record.AreaNid,
+			secretApiKeField:         maskSensitive(v.Record.ApiKey),
+			secretUsernameField:      maskSensitive(v.Record.Username),
+			secretQpsField:           v.Record.MaxQPS,
+			secretLeaseDurationField: v.Record.LeaseDuration,
+			secretV2CapableField:     sufficientForV2(&v.Record),
+			secretV3CapableField:     sufficientForV3(&v.Record),
+		})
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			versionsField: versions,
+		},
+	}, nil
+}
+
+func (b *AuthPlugin) handleRollback(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	credsName := data.Get(credentialsName).(string)
+	version := data.Get(versionField).(int)
+
+	b.credsLock.Lock()
+	defer b.credsLock.Unlock()
+
+	// The pending value of the incomplete rotation could have been accepted by Mashery; it is settled by the next
+	// rotation, and would be lost if the credentials were replaced.
+	if storedRec, err := getAuthRecordByName(ctx, req.Storage, credsName); err != nil {
+		return nil, err
+	} else if storedRec != nil && len(storedRec.PendingPassword) > 0 {
+		return logical.ErrorResponse("password rotation of credentials '%s' is pending; rotate the password to settle it before rollback", credsName), nil
+	} else if storedRec != nil && len(storedRec.PendingKeySecret) > 0 {
+		return logical.ErrorResponse("key secret rotation of credentials '%s' is pending; rotate the secret to settle it before rollback", credsName), nil
+	}
+
+	h, err := getCredentialsHistory(ctx, req.Storage, credsName)
+	if err != nil {
+		return nil, err
+	}
+
+	v := h.find(version)
+	if v == nil {
+		return logical.ErrorResponse("version %d of credentials '%s' is not retained", version, credsName), nil
+	} else if version == h.latest() {
+		return logical.ErrorResponse("version %d is the current version", version), nil
+	} else if v.Operation == versionOpDelete {
+		return logical.ErrorResponse("version %d records the delete of the credentials; delete the credentials instead", version), nil
+	}
+
+	restored := v.Record
+	// Incomplete rotations of the restored version are not resumed.
+	restored.PendingPassword = ""
+	restored.PendingKeySecret = ""
+
+	if err := putAuthRecordVersion(ctx, req.Storage, credsName, &restored, req.DisplayName, req.EntityID, versionOpRollback); err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("Restored credentials version", "credentials", credsName, "version", version)
+	return &logical.Response{
+		Data: map[string]interface{}{
+			versionField: h.latest() + 1,
+		},
+		Warnings: []string{fmt.Sprintf("restored version %d; the values rotated since then may no longer be accepted by Mashery", version)},
+	}, nil
+}
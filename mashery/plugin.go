@@ -2,16 +2,40 @@ package mashery
 
 import (
 	"context"
+	"fmt"
 	"github.com/aliakseiyanchuk/mashery-v3-go-client/v3client"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 type AuthPlugin struct {
 	*framework.Backend
 
-	v3OauthHelper *v3client.V3OAuthHelper
+	v3OauthHelper oauthHelper
+	httpClient    *http.Client
+
+	// clientLock guards the HTTP clients of the customized transport settings
+	clientLock  sync.Mutex
+	httpClients map[string]*cachedHttpClient
+
+	// qpsLock serializes updates of the QPS budgets
+	qpsLock sync.Mutex
+	// tokenLock serializes updates of the V3 token caches
+	tokenLock sync.Mutex
+	// credsLock serializes changes of the stored credentials
+	credsLock sync.Mutex
+	// clockLock guards the calibrated offsets of Mashery server time
+	clockLock     sync.Mutex
+	serverOffsets map[string]calibratedOffset
+	// rotationLock guards the failed scheduled password rotations
+	rotationLock     sync.Mutex
+	rotationAttempts map[string]passwordRotationAttempt
+	// handoffLock ensures that each handoff code is redeemed at most once
+	handoffLock sync.Mutex
 }
 
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
@@ -28,26 +52,71 @@ func makeNew() (*AuthPlugin, error) {
 
 	retVal := AuthPlugin{
 		v3OauthHelper: v3client.NewOAuthHelper(),
+		httpClient:    &http.Client{Timeout: time.Second * 30},
+		httpClients:   map[string]*cachedHttpClient{},
+		serverOffsets: map[string]calibratedOffset{},
+
+		rotationAttempts: map[string]passwordRotationAttempt{},
 	}
 
 	retVal.Backend = &framework.Backend{
 		Help:        strings.TrimSpace(pluginHelp),
 		BackendType: logical.TypeLogical,
 		Paths: []*framework.Path{
+			pathConfig(&retVal),
+			pathAreaList(&retVal),
 			pathAreaData(&retVal),
+			pathAreaVerify(&retVal),
+			pathAreaRotatePassword(&retVal),
+			pathAreaRotateSecret(&retVal),
+			pathAreaVersions(&retVal),
+			pathAreaRollback(&retVal),
+			pathCredentialsExport(&retVal),
+			pathCredentialsImport(&retVal),
+			pathHandoff(&retVal),
 			pathV2Credentials(&retVal),
+			pathV2Schedule(&retVal),
 			pathV3Credentials(&retVal),
+			pathRolesList(&retVal),
+			pathRoles(&retVal),
+			pathRoleCredentials(&retVal),
+			pathKeys(&retVal),
+			pathFixtures(&retVal),
 		},
 		Secrets: []*framework.Secret{
 			v2AccessSecret(&retVal),
+			v2ScheduleSecret(&retVal),
 			v3AccessSecret(&retVal),
+			packageKeySecret(&retVal),
+			fixtureSecret(&retVal),
 		},
+		PeriodicFunc: retVal.periodic,
 	}
 
 	retVal.Logger().Info("Mashery V2/V3 authentication plugin has been initialized")
 	return &retVal, nil
 }
 
+// periodic runs the background maintenance of the mount. Each task runs even if the preceding ones failed; the
+// errors of all tasks are combined.
+func (b *AuthPlugin) periodic(ctx context.Context, req *logical.Request) error {
+	var errs []string
+	for _, task := range []func(context.Context, *logical.Request) error{
+		b.refreshCachedTokens,
+		b.purgeExpiredHandoffs,
+		b.rotateDuePasswords,
+	} {
+		if err := task(ctx, req); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("periodic maintenance failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 // noopRenewRevoke revocation of the secret that was issued
 func (b *AuthPlugin) noopRenewRevoke(context.Context, *logical.Request, *framework.FieldData) (*logical.Response, error) {
 	return nil, nil
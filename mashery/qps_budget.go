@@ -0,0 +1,186 @@
+package mashery
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"time"
+)
+
+// QPS budget tracks QPS allocated to the outstanding V2 and V3 leases of the credentials that enforce the QPS
+// budget. The sum of the allocated QPS never exceeds the QPS stored with the credentials. The allocation is released
+// when the lease is revoked or expires. Allocations carry their own expiry time so that allocations of the leases
+// whose revocation was missed would eventually be released.
+
+const (
+	qpsBudgetStoragePrefix = "qps/"
+
+	secretInternalQpsAllocation = "qps_allocation"
+)
+
+type qpsAllocation struct {
+	QPS        int   `json:"qps"`
+	ExpiryTime int64 `json:"expiry_time"`
+}
+
+type qpsBudget struct {
+	Allocations map[string]qpsAllocation `json:"allocations"`
+}
+
+func (qb *qpsBudget) allocated(now time.Time) int {
+	retVal := 0
+	for id, a := range qb.Allocations {
+		if a.ExpiryTime <= now.Unix() {
+			delete(qb.Allocations, id)
+		} else {
+			retVal += a.QPS
+		}
+	}
+
+	return retVal
+}
+
+func storagePathForQpsBudget(credsName string) string {
+	return qpsBudgetStoragePrefix + credsName
+}
+
+// credentialsNameOfInternalData name of the credentials the secret was issued from.
+func credentialsNameOfInternalData(internalData map[string]interface{}) string {
+	if storagePath, ok := internalData[secretInternalSiteStoragePath].(string); ok {
+		return strings.TrimPrefix(storagePath, areaStoragePrefix)
+	}
+
+	return ""
+}
+
+func getQpsBudget(ctx context.Context, s logical.Storage, credsName string) (*qpsBudget, error) {
+	retVal := qpsBudget{}
+
+	if entry, err := s.Get(ctx, storagePathForQpsBudget(credsName)); err != nil {
+		return nil, err
+	} else if entry != nil {
+		if err := entry.DecodeJSON(&retVal); err != nil {
+			return nil, errwrap.Wrapf("cannot unmarshal QPS budget ({{err}})", err)
+		}
+	}
+
+	if retVal.Allocations == nil {
+		retVal.Allocations = map[string]qpsAllocation{}
+	}
+	return &retVal, nil
+}
+
+func putQpsBudget(ctx context.Context, s logical.Storage, credsName string, qb *qpsBudget) error {
+	if len(qb.Allocations) == 0 {
+		return s.Delete(ctx, storagePathForQpsBudget(credsName))
+	}
+
+	if se, err := logical.StorageEntryJSON(storagePathForQpsBudget(credsName), qb); err != nil {
+		return errwrap.Wrapf("failed to save QPS budget: {{err}}", err)
+	} else {
+		return s.Put(ctx, se)
+	}
+}
+
+// allocateQPS allocates up to the requested QPS from the budget of the credentials for the specified duration.
+// The lesser QPS is granted if the budget is insufficient; the allocation is refused if no QPS is left. If the
+// credentials do not enforce QPS budget, the requested QPS is granted and the allocation id is empty.
+func (b *AuthPlugin) allocateQPS(ctx context.Context, s logical.Storage, credsName string, requested int, ttl time.Duration) (string, int, error) {
+	b.qpsLock.Lock()
+	defer b.qpsLock.Unlock()
+
+	storedRec, err := getAuthRecordByName(ctx, s, credsName)
+	if err != nil {
+		return "", 0, err
+	} else if storedRec == nil || !storedRec.EnforceQPS {
+		return "", requested, nil
+	}
+
+	v3Rec, err := b.withMountDefaults(ctx, s, storedRec)
+	if err != nil {
+		return "", 0, err
+	}
+
+	qb, err := getQpsBudget(ctx, s, credsName)
+	if err != nil {
+		return "", 0, err
+	}
+
+	now := time.Now()
+	available := v3Rec.MaxQPS - qb.allocated(now)
+	if available <= 0 {
+		return "", 0, fmt.Errorf("qps budget of credentials '%s' is exhausted", credsName)
+	}
+
+	granted := min(requested, available)
+	allocId, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", 0, err
+	}
+
+	qb.Allocations[allocId] = qpsAllocation{
+		QPS:        granted,
+		ExpiryTime: now.Add(ttl).Unix(),
+	}
+
+	b.Logger().Info("Allocated QPS", "credentials", credsName, "requested", requested, "granted", granted)
+	return allocId, granted, putQpsBudget(ctx, s, credsName, qb)
+}
+
+// releaseQPS releases QPS allocated to the lease of the secret.
+func (b *AuthPlugin) releaseQPS(ctx context.Context, s logical.Storage, internalData map[string]interface{}) error {
+	return b.updateQpsAllocation(ctx, s, internalData, func(qb *qpsBudget, allocId string) error {
+		delete(qb.Allocations, allocId)
+		return nil
+	})
+}
+
+// extendQPS extends allocation of the lease of the secret by the specified duration. The extension is refused if
+// the allocation has already expired, as its QPS could have been granted to other leases since.
+func (b *AuthPlugin) extendQPS(ctx context.Context, s logical.Storage, internalData map[string]interface{}, ttl time.Duration) error {
+	credsName := credentialsNameOfInternalData(internalData)
+
+	return b.updateQpsAllocation(ctx, s, internalData, func(qb *qpsBudget, allocId string) error {
+		a, ok := qb.Allocations[allocId]
+		if !ok || a.ExpiryTime <= time.Now().Unix() {
+			if storedRec, err := getAuthRecordByName(ctx, s, credsName); err != nil {
+				return err
+			} else if storedRec != nil && storedRec.EnforceQPS {
+				return fmt.Errorf("qps allocation of the lease of credentials '%s' has expired", credsName)
+			}
+
+			// The credentials no longer enforce QPS budget.
+			return nil
+		}
+
+		a.ExpiryTime = time.Now().Add(ttl).Unix()
+		qb.Allocations[allocId] = a
+		return nil
+	})
+}
+
+func (b *AuthPlugin) updateQpsAllocation(ctx context.Context, s logical.Storage, internalData map[string]interface{}, f func(*qpsBudget, string) error) error {
+	allocId, ok := internalData[secretInternalQpsAllocation].(string)
+	if !ok || len(allocId) == 0 {
+		return nil
+	}
+
+	b.qpsLock.Lock()
+	defer b.qpsLock.Unlock()
+
+	credsName := credentialsNameOfInternalData(internalData)
+	qb, err := getQpsBudget(ctx, s, credsName)
+	if err != nil {
+		return err
+	}
+
+	if err := f(qb, allocId); err != nil {
+		return err
+	}
+	qb.allocated(time.Now())
+
+	return putQpsBudget(ctx, s, credsName, qb)
+}
@@ -0,0 +1,350 @@
+package mashery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aliakseiyanchuk/mashery-v3-go-client/v3client"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"time"
+)
+
+// V3 token cache keeps the current access token of the credentials that opt into the cached mode. The same token
+// is handed out to multiple leases; each token counts the leases referring to it. When the current token is close to
+// its expiry, it is replaced: the token that is not referred to by any lease is refreshed using its refresh token,
+// whereas the token that is still in use is retired and is invalidated when the last lease referring to it is
+// revoked.
+
+const (
+	tokenCacheStoragePrefix = "token/"
+
+	secretInternalCachedTokenId = "cached_token_id"
+
+	// Minimum remaining life time, in seconds, of the cached token that is handed out to a new lease.
+	v3CacheMinRemainingTime = 5 * 60
+	// Remaining life time, in seconds, of the cached token at which the token is refreshed in the background.
+	v3RefreshAheadTime = 2 * 60
+)
+
+type cachedV3Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiryTime   int64  `json:"expiry_time"`
+	Leases       int    `json:"leases"`
+}
+
+func (t *cachedV3Token) remainingTime(now time.Time) int {
+	return int(t.ExpiryTime - now.Unix())
+}
+
+type v3TokenCache struct {
+	Current string                    `json:"current"`
+	Tokens  map[string]*cachedV3Token `json:"tokens"`
+}
+
+func (c *v3TokenCache) current() *cachedV3Token {
+	return c.Tokens[c.Current]
+}
+
+func storagePathForTokenCache(credsName string) string {
+	return tokenCacheStoragePrefix + credsName
+}
+
+func getTokenCache(ctx context.Context, s logical.Storage, credsName string) (*v3TokenCache, error) {
+	retVal := v3TokenCache{}
+
+	if entry, err := s.Get(ctx, storagePathForTokenCache(credsName)); err != nil {
+		return nil, err
+	} else if entry != nil {
+		if err := entry.DecodeJSON(&retVal); err != nil {
+			return nil, errwrap.Wrapf("cannot unmarshal V3 token cache ({{err}})", err)
+		}
+	}
+
+	if retVal.Tokens == nil {
+		retVal.Tokens = map[string]*cachedV3Token{}
+	}
+	return &retVal, nil
+}
+
+func putTokenCache(ctx context.Context, s logical.Storage, credsName string, c *v3TokenCache) error {
+	if len(c.Tokens) == 0 {
+		return s.Delete(ctx, storagePathForTokenCache(credsName))
+	}
+
+	if se, err := logical.StorageEntryJSON(storagePathForTokenCache(credsName), c); err != nil {
+		return errwrap.Wrapf("failed to save V3 token cache: {{err}}", err)
+	} else {
+		return s.Put(ctx, se)
+	}
+}
+
+// cacheToken makes the token the current token of the cache.
+func cacheToken(c *v3TokenCache, tkn *v3client.TimedAccessTokenResponse, now time.Time) error {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+
+	c.Tokens[id] = &cachedV3Token{
+		AccessToken:  tkn.AccessToken,
+		RefreshToken: tkn.RefreshToken,
+		ExpiryTime:   now.Add(time.Second * time.Duration(tkn.ExpiresIn)).Unix(),
+	}
+	c.Current = id
+	return nil
+}
+
+// replaceCurrentToken obtains a new current token. The unused current token is exchanged for the new one; the token
+// that is still referred to by the leases is retired.
+func (b *AuthPlugin) replaceCurrentToken(helper oauthHelper, c *v3TokenCache, v3Rec *AuthRec, now time.Time) error {
+	v3Credentials := v3Rec.asV3Credentials()
+
+	var tkn *v3client.TimedAccessTokenResponse
+	var err error
+
+	if cur := c.current(); cur != nil && cur.Leases == 0 && cur.remainingTime(now) > 0 {
+		tkn, err = helper.ExchangeRefreshToken(&v3Credentials, cur.RefreshToken)
+		delete(c.Tokens, c.Current)
+	} else {
+		tkn, err = helper.RetrieveAccessTokenFor(&v3Credentials)
+	}
+
+	if err != nil {
+		return errwrap.Wrapf("access token was not granted: {{err}}", err)
+	}
+
+	return cacheToken(c, tkn, now)
+}
+
+// acquireCachedV3Token returns the current token of the cache for a new lease, obtaining a new token if the current
+// one is missing or close to the expiry.
+func (b *AuthPlugin) acquireCachedV3Token(ctx context.Context, s logical.Storage, helper oauthHelper, credsName string, v3Rec *AuthRec) (string, *v3client.TimedAccessTokenResponse, error) {
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	c, err := getTokenCache(ctx, s, credsName)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	if cur := c.current(); cur == nil || cur.remainingTime(now) < v3CacheMinRemainingTime {
+		if err := b.replaceCurrentToken(helper, c, v3Rec, now); err != nil {
+			return "", nil, err
+		}
+	}
+
+	cur := c.current()
+	cur.Leases++
+
+	if err := putTokenCache(ctx, s, credsName, c); err != nil {
+		return "", nil, err
+	}
+
+	tkn := v3client.TimedAccessTokenResponse{}
+	tkn.AccessToken = cur.AccessToken
+	tkn.ExpiresIn = cur.remainingTime(now)
+
+	b.Logger().Info("Handing out cached V3 access token", "credentials", credsName, "leases", cur.Leases)
+	return c.Current, &tkn, nil
+}
+
+// releaseCachedV3Token drops the reference of the lease to the cached token. The retired token is invalidated when
+// the last lease referring to it is revoked.
+func (b *AuthPlugin) releaseCachedV3Token(ctx context.Context, s logical.Storage, credsName string, id string, v3Rec *AuthRec) error {
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	c, err := getTokenCache(ctx, s, credsName)
+	if err != nil {
+		return err
+	}
+
+	tkn, ok := c.Tokens[id]
+	if !ok {
+		return nil
+	}
+
+	if tkn.Leases > 0 {
+		tkn.Leases--
+	}
+
+	if tkn.Leases == 0 && id != c.Current {
+		delete(c.Tokens, id)
+
+		if v3Rec != nil && suppliesKeyAndSecret(v3Rec) && tkn.remainingTime(time.Now()) > 0 {
+			v3Credentials := v3Rec.asV3Credentials()
+			if helper, err := b.oauthHelperOf(ctx, s, v3Rec); err != nil {
+				b.Logger().Error("Cannot create OAuth helper to invalidate retired cached token", "error", err)
+			} else if _, err = helper.ExchangeRefreshToken(&v3Credentials, tkn.RefreshToken); err != nil {
+				b.Logger().Error("Error returned while trying to invalidate retired cached token", "error", err)
+			}
+		}
+	}
+
+	return putTokenCache(ctx, s, credsName, c)
+}
+
+// refreshCachedTokens is run periodically to replace the cached tokens shortly before these expire. The current token
+// that no lease refers to is refreshed with its refresh token. The token that is still referred to is retired and left
+// to expire, as exchanging its refresh token would invalidate the access token the leases hold; the leases are moved
+// to the new current token upon renewal.
+func (b *AuthPlugin) refreshCachedTokens(ctx context.Context, req *logical.Request) error {
+	names, err := req.Storage.List(ctx, tokenCacheStoragePrefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list V3 token caches: {{err}}", err)
+	}
+
+	var errs []string
+	for _, credsName := range names {
+		if err := b.refreshCachedTokensOf(ctx, req.Storage, credsName); err != nil {
+			b.Logger().Error("Error refreshing cached V3 access tokens", "credentials", credsName, "error", err)
+			errs = append(errs, fmt.Sprintf("credentials '%s': %s", credsName, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to refresh cached V3 access tokens: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (b *AuthPlugin) refreshCachedTokensOf(ctx context.Context, s logical.Storage, credsName string) error {
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	c, err := getTokenCache(ctx, s, credsName)
+	if err != nil {
+		return err
+	}
+
+	v3Rec, err := getAuthRecordByName(ctx, s, credsName)
+	if err != nil {
+		return err
+	} else if v3Rec == nil || !suppliesKeyAndSecret(v3Rec) {
+		// Credentials were removed; tokens of the outstanding leases will expire by themselves.
+		return s.Delete(ctx, storagePathForTokenCache(credsName))
+	}
+
+	helper, err := b.oauthHelperOf(ctx, s, v3Rec)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	var refreshErr error
+	for id, tkn := range c.Tokens {
+		if tkn.remainingTime(now) > v3RefreshAheadTime {
+			continue
+		} else if tkn.Leases > 0 {
+			// The token in use is retired; the next lease is handed out a new token.
+			if id == c.Current {
+				c.Current = ""
+				b.Logger().Info("Retired cached V3 access token in use", "credentials", credsName, "leases", tkn.Leases)
+			}
+			continue
+		} else if id != c.Current {
+			// The retired token is dropped once its last lease was released.
+			delete(c.Tokens, id)
+			continue
+		}
+
+		if err := b.refreshCachedToken(helper, credsName, tkn, v3Rec, now); err != nil {
+			refreshErr = errwrap.Wrapf("cached access token was not refreshed: {{err}}", err)
+			if tkn.remainingTime(now) <= 0 {
+				delete(c.Tokens, id)
+			}
+		}
+	}
+
+	if c.current() == nil {
+		c.Current = ""
+	}
+
+	if err := putTokenCache(ctx, s, credsName, c); err != nil {
+		return err
+	}
+	return refreshErr
+}
+
+// refreshCachedToken exchanges the shared refresh token of the cached token; the leases referring to the cached token
+// receive the new access token upon renewal.
+func (b *AuthPlugin) refreshCachedToken(helper oauthHelper, credsName string, tkn *cachedV3Token, v3Rec *AuthRec, now time.Time) error {
+	v3Credentials := v3Rec.asV3Credentials()
+
+	refreshed, err := helper.ExchangeRefreshToken(&v3Credentials, tkn.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	tkn.AccessToken = refreshed.AccessToken
+	tkn.RefreshToken = refreshed.RefreshToken
+	tkn.ExpiryTime = now.Add(time.Second * time.Duration(refreshed.ExpiresIn)).Unix()
+
+	b.Logger().Info("Refreshed cached V3 access token", "credentials", credsName, "exp", tkn.ExpiryTime)
+	return nil
+}
+
+// cachedTokenOfSecret returns the cached token the lease of the secret refers to, or nil if the secret was
+// not issued from the cache. If the cached token is about to expire, the lease is moved to the current token of the
+// cache, so that the access token held by the other leases of the expiring token remains valid. The expiring token
+// that only this lease refers to is refreshed instead.
+func (b *AuthPlugin) cachedTokenOfSecret(ctx context.Context, req *logical.Request, v3Rec *AuthRec) (*cachedV3Token, error) {
+	id, ok := req.Secret.InternalData[secretInternalCachedTokenId].(string)
+	if !ok || len(id) == 0 {
+		return nil, nil
+	}
+
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	credsName := credentialsNameOfInternalData(req.Secret.InternalData)
+	c, err := getTokenCache(ctx, req.Storage, credsName)
+	if err != nil {
+		return nil, err
+	}
+
+	tkn, ok := c.Tokens[id]
+	if !ok {
+		return nil, errors.New("cached access token of the lease is no longer available")
+	}
+
+	now := time.Now()
+	if tkn.remainingTime(now) > v3RefreshAheadTime || v3Rec == nil || !suppliesKeyAndSecret(v3Rec) {
+		return tkn, nil
+	}
+
+	helper, err := b.oauthHelperOf(ctx, req.Storage, v3Rec)
+	if err != nil {
+		return nil, err
+	}
+
+	if tkn.Leases <= 1 {
+		if err := b.refreshCachedToken(helper, credsName, tkn, v3Rec, now); err != nil {
+			b.Logger().Warn("Cached access token was not refreshed", "credentials", credsName, "error", err)
+			return tkn, nil
+		}
+		return tkn, putTokenCache(ctx, req.Storage, credsName, c)
+	}
+
+	// The expiring token, if still current, is retired by the replacement.
+	if cur := c.current(); cur == nil || cur.remainingTime(now) < v3CacheMinRemainingTime {
+		if err := b.replaceCurrentToken(helper, c, v3Rec, now); err != nil {
+			b.Logger().Warn("Cached access token was not replaced", "credentials", credsName, "error", err)
+			return tkn, nil
+		}
+	}
+
+	tkn.Leases--
+	cur := c.current()
+	cur.Leases++
+	req.Secret.InternalData[secretInternalCachedTokenId] = c.Current
+
+	b.Logger().Info("Moved lease to the current cached V3 access token", "credentials", credsName, "leases", cur.Leases)
+	return cur, putTokenCache(ctx, req.Storage, credsName, c)
+}
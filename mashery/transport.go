@@ -0,0 +1,473 @@
+package mashery
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aliakseiyanchuk/mashery-v3-go-client/v3client"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Mashery endpoints and the HTTP transport used to reach them. The settings can be specified mount-wide in the
+// config path and can be overridden for each credentials. Settings that are not specified in either place are
+// replaced with the defaults suitable for Mashery SaaS.
+
+const (
+	transportTokenEndpointField = "token_endpoint"
+	transportV2EndpointField    = "v2_endpoint"
+	transportV3EndpointField    = "v3_endpoint"
+	transportProxyField         = "proxy"
+	transportCABundleField      = "ca_bundle"
+	transportTimeoutField       = "timeout"
+	transportMaxRetriesField    = "max_retries"
+	transportRetryWaitField     = "retry_wait"
+
+	defaultTokenEndpoint = "https://api.mashery.com/v3/token"
+	defaultV3Endpoint    = "https://api.mashery.com/v3/rest"
+	defaultTimeout       = 30
+	defaultRetryWait     = 1
+
+	// Maximum number of HTTP clients of the customized transport settings kept for reuse.
+	maxCachedHttpClients = 16
+)
+
+// oauthHelper obtains and refreshes Mashery V3 access tokens.
+type oauthHelper interface {
+	RetrieveAccessTokenFor(creds *v3client.MasheryV3Credentials) (*v3client.TimedAccessTokenResponse, error)
+	ExchangeRefreshToken(creds *v3client.MasheryV3Credentials, refreshToken string) (*v3client.TimedAccessTokenResponse, error)
+}
+
+// TransportRec Mashery endpoints and HTTP transport settings.
+type TransportRec struct {
+	TokenEndpoint string `json:"token_endpoint,omitempty"`
+	V2Endpoint    string `json:"v2_endpoint,omitempty"`
+	V3Endpoint    string `json:"v3_endpoint,omitempty"`
+	Proxy         string `json:"proxy,omitempty"`
+	CABundle      string `json:"ca_bundle,omitempty"`
+	Timeout       int    `json:"timeout,omitempty"`
+	MaxRetries    int    `json:"max_retries,omitempty"`
+	RetryWait     int    `json:"retry_wait,omitempty"`
+}
+
+// customized whether any of the settings differs from the defaults.
+func (t TransportRec) customized() bool {
+	return t != TransportRec{}
+}
+
+// inherit fills the settings that are not specified with the settings of the other.
+func (t TransportRec) inherit(other TransportRec) TransportRec {
+	if len(t.TokenEndpoint) == 0 {
+		t.TokenEndpoint = other.TokenEndpoint
+	}
+	if len(t.V2Endpoint) == 0 {
+		t.V2Endpoint = other.V2Endpoint
+	}
+	if len(t.V3Endpoint) == 0 {
+		t.V3Endpoint = other.V3Endpoint
+	}
+	if len(t.Proxy) == 0 {
+		t.Proxy = other.Proxy
+	}
+	if len(t.CABundle) == 0 {
+		t.CABundle = other.CABundle
+	}
+	if t.Timeout == 0 {
+		t.Timeout = other.Timeout
+	}
+	if t.MaxRetries == 0 {
+		t.MaxRetries = other.MaxRetries
+	}
+	if t.RetryWait == 0 {
+		t.RetryWait = other.RetryWait
+	}
+
+	return t
+}
+
+func (t TransportRec) tokenEndpoint() string {
+	if len(t.TokenEndpoint) > 0 {
+		return t.TokenEndpoint
+	}
+	return defaultTokenEndpoint
+}
+
+func (t TransportRec) v2Endpoint() string {
+	if len(t.V2Endpoint) > 0 {
+		return strings.TrimSuffix(t.V2Endpoint, "/")
+	}
+	return v2ApiEndpoint
+}
+
+func (t TransportRec) v3Endpoint() string {
+	if len(t.V3Endpoint) > 0 {
+		return strings.TrimSuffix(t.V3Endpoint, "/")
+	}
+	return defaultV3Endpoint
+}
+
+func transportFieldSchemas(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+	fields[transportTokenEndpointField] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Mashery V3 token endpoint URL. Defaults to " + defaultTokenEndpoint,
+		DisplayName: "V3 token endpoint",
+	}
+	fields[transportV2EndpointField] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Mashery V2 JSON-RPC API base URL. Defaults to " + v2ApiEndpoint,
+		DisplayName: "V2 API base URL",
+	}
+	fields[transportV3EndpointField] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Mashery V3 REST API base URL. Defaults to " + defaultV3Endpoint,
+		DisplayName: "V3 API base URL",
+	}
+	fields[transportProxyField] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "HTTP proxy URL used to reach Mashery",
+		DisplayName: "HTTP proxy",
+	}
+	fields[transportCABundleField] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "PEM-encoded CA certificates trusted in addition to the system ones",
+		DisplayName: "CA bundle",
+	}
+	fields[transportTimeoutField] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "HTTP client timeout. Defaults to 30 seconds",
+		DisplayName: "Client timeout",
+	}
+	fields[transportMaxRetriesField] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "Number of times a failed call to Mashery is retried. Defaults to no retries",
+		DisplayName: "Maximum retries",
+	}
+	fields[transportRetryWaitField] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Initial wait between the retries; doubled after each retry. Defaults to 1 second",
+		DisplayName: "Retry wait",
+	}
+
+	return fields
+}
+
+func mergeTransportFieldsInto(data *framework.FieldData, t *TransportRec) {
+	if raw, ok := data.GetOk(transportTokenEndpointField); ok {
+		t.TokenEndpoint = raw.(string)
+	}
+	if raw, ok := data.GetOk(transportV2EndpointField); ok {
+		t.V2Endpoint = raw.(string)
+	}
+	if raw, ok := data.GetOk(transportV3EndpointField); ok {
+		t.V3Endpoint = raw.(string)
+	}
+	if raw, ok := data.GetOk(transportProxyField); ok {
+		t.Proxy = raw.(string)
+	}
+	if raw, ok := data.GetOk(transportCABundleField); ok {
+		t.CABundle = raw.(string)
+	}
+	if raw, ok := data.GetOk(transportTimeoutField); ok {
+		t.Timeout = raw.(int)
+	}
+	if raw, ok := data.GetOk(transportMaxRetriesField); ok {
+		t.MaxRetries = raw.(int)
+	}
+	if raw, ok := data.GetOk(transportRetryWaitField); ok {
+		t.RetryWait = raw.(int)
+	}
+}
+
+// redactProxy masks the user name and password the proxy URL may carry.
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return maskSensitive(proxy)
+	} else if u.User == nil {
+		return proxy
+	}
+
+	if password, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(maskSensitive(u.User.Username()), maskSensitive(password))
+	} else {
+		u.User = url.User(maskSensitive(u.User.Username()))
+	}
+	return u.String()
+}
+
+func transportResponseData(t TransportRec, data map[string]interface{}) map[string]interface{} {
+	data[transportTokenEndpointField] = t.TokenEndpoint
+	data[transportV2EndpointField] = t.V2Endpoint
+	data[transportV3EndpointField] = t.V3Endpoint
+	data[transportProxyField] = redactProxy(t.Proxy)
+	data[transportCABundleField] = t.CABundle
+	data[transportTimeoutField] = t.Timeout
+	data[transportMaxRetriesField] = t.MaxRetries
+	data[transportRetryWaitField] = t.RetryWait
+
+	return data
+}
+
+func validateTransport(t TransportRec) error {
+	for _, u := range []string{t.TokenEndpoint, t.V2Endpoint, t.V3Endpoint, t.Proxy} {
+		if len(u) == 0 {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || len(parsed.Scheme) == 0 || len(parsed.Host) == 0 {
+			return fmt.Errorf("'%s' is not a valid absolute URL", u)
+		}
+	}
+
+	if len(t.CABundle) > 0 && !x509.NewCertPool().AppendCertsFromPEM([]byte(t.CABundle)) {
+		return errors.New("ca_bundle does not contain PEM-encoded certificates")
+	}
+
+	if t.Timeout < 0 || t.MaxRetries < 0 || t.RetryWait < 0 {
+		return errors.New("timeout, max_retries and retry_wait must not be negative")
+	}
+
+	return nil
+}
+
+// transportOf effective transport settings of the credentials.
+func (b *AuthPlugin) transportOf(ctx context.Context, s logical.Storage, v3Rec *AuthRec) (TransportRec, error) {
+	if cfg, err := getMountConfig(ctx, s); err != nil {
+		return TransportRec{}, err
+	} else {
+		return v3Rec.TransportRec.inherit(cfg.TransportRec), nil
+	}
+}
+
+func newHttpClient(t TransportRec) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if len(t.Proxy) > 0 {
+		if proxyUrl, err := url.Parse(t.Proxy); err != nil {
+			return nil, errwrap.Wrapf("invalid proxy URL: {{err}}", err)
+		} else {
+			transport.Proxy = http.ProxyURL(proxyUrl)
+		}
+	}
+
+	if len(t.CABundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(t.CABundle)) {
+			return nil, errors.New("ca_bundle does not contain PEM-encoded certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	timeout := defaultTimeout
+	if t.Timeout > 0 {
+		timeout = t.Timeout
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * time.Duration(timeout),
+	}, nil
+}
+
+// clientKeyOf hash of the settings that shape the HTTP client; the endpoints and the retry policy do not.
+func clientKeyOf(t TransportRec) string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", t.Proxy, t.CABundle, t.Timeout)))
+	return hex.EncodeToString(digest[:])
+}
+
+// cachedHttpClient HTTP client of the customized transport settings, and the time it was last used.
+type cachedHttpClient struct {
+	client   *http.Client
+	lastUsed time.Time
+}
+
+// customHttpClient returns the HTTP client for the customized transport settings. Clients are reused for the same
+// settings so that their idle connections and TLS sessions are reused as well. Settings change over time, so only the
+// most recently used clients are kept; the idle connections of the dropped client are closed.
+func (b *AuthPlugin) customHttpClient(t TransportRec) (*http.Client, error) {
+	key := clientKeyOf(t)
+
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	now := time.Now()
+	if cached, ok := b.httpClients[key]; ok {
+		cached.lastUsed = now
+		return cached.client, nil
+	}
+
+	cl, err := newHttpClient(t)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.httpClients) >= maxCachedHttpClients {
+		b.dropLeastRecentlyUsedHttpClient()
+	}
+
+	b.httpClients[key] = &cachedHttpClient{client: cl, lastUsed: now}
+	return cl, nil
+}
+
+// dropLeastRecentlyUsedHttpClient removes the client that was not used for the longest time; the caller holds the
+// client lock.
+func (b *AuthPlugin) dropLeastRecentlyUsedHttpClient() {
+	var lruKey string
+	var lru *cachedHttpClient
+	for key, cached := range b.httpClients {
+		if lru == nil || cached.lastUsed.Before(lru.lastUsed) {
+			lruKey, lru = key, cached
+		}
+	}
+
+	if lru != nil {
+		delete(b.httpClients, lruKey)
+		lru.client.CloseIdleConnections()
+	}
+}
+
+// httpClientOf HTTP client and the effective transport settings of the credentials.
+func (b *AuthPlugin) httpClientOf(ctx context.Context, s logical.Storage, v3Rec *AuthRec) (*http.Client, TransportRec, error) {
+	t, err := b.transportOf(ctx, s, v3Rec)
+	if err != nil {
+		return nil, t, err
+	} else if !t.customized() {
+		return b.httpClient, t, nil
+	}
+
+	cl, err := b.customHttpClient(t)
+	return cl, t, err
+}
+
+// oauthHelperOf V3 OAuth helper reaching the token endpoint of the credentials.
+func (b *AuthPlugin) oauthHelperOf(ctx context.Context, s logical.Storage, v3Rec *AuthRec) (oauthHelper, error) {
+	t, err := b.transportOf(ctx, s, v3Rec)
+	if err != nil {
+		return nil, err
+	} else if !t.customized() {
+		return b.v3OauthHelper, nil
+	}
+
+	if cl, err := b.customHttpClient(t); err != nil {
+		return nil, err
+	} else {
+		return &httpOAuthHelper{ctx: ctx, client: cl, transport: t}, nil
+	}
+}
+
+// retryable whether the failed attempt can be repeated. Idempotent requests are repeated on network errors and
+// server errors; other requests, such as password updates, are repeated only if Mashery refused these before
+// processing (429 Too Many Requests or 503 Service Unavailable).
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return err != nil || resp.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+// doWithRetry executes the request produced by the factory, retrying the attempts that failed temporarily. Waiting
+// between the attempts is abandoned when the context is cancelled.
+func doWithRetry(ctx context.Context, cl *http.Client, t TransportRec, newReq func() (*http.Request, error)) (*http.Response, error) {
+	wait := time.Second * time.Duration(defaultRetryWait)
+	if t.RetryWait > 0 {
+		wait = time.Second * time.Duration(t.RetryWait)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		resp, err := cl.Do(req)
+		if attempt >= t.MaxRetries || ctx.Err() != nil || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+// httpOAuthHelper V3 OAuth helper for the credentials using customized endpoint or HTTP transport.
+type httpOAuthHelper struct {
+	ctx       context.Context
+	client    *http.Client
+	transport TransportRec
+}
+
+func (h *httpOAuthHelper) RetrieveAccessTokenFor(creds *v3client.MasheryV3Credentials) (*v3client.TimedAccessTokenResponse, error) {
+	return h.postForToken(creds, url.Values{
+		"grant_type": {"password"},
+		"username":   {creds.Username},
+		"password":   {creds.Password},
+		"scope":      {creds.AreaId},
+	})
+}
+
+func (h *httpOAuthHelper) ExchangeRefreshToken(creds *v3client.MasheryV3Credentials, refreshToken string) (*v3client.TimedAccessTokenResponse, error) {
+	return h.postForToken(creds, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+func (h *httpOAuthHelper) postForToken(creds *v3client.MasheryV3Credentials, data url.Values) (*v3client.TimedAccessTokenResponse, error) {
+	resp, err := doWithRetry(h.ctx, h.client, h.transport, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, h.transport.tokenEndpoint(), strings.NewReader(data.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(creds.ApiKey, creds.Secret)
+		return req, nil
+	})
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to retrieve response from the token endpoint: {{err}}", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to read token endpoint response: {{err}}", err)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned unexpected status code %d", resp.StatusCode)
+	}
+
+	retVal := v3client.TimedAccessTokenResponse{}
+	if err := json.Unmarshal(body, &retVal); err != nil {
+		return nil, errwrap.Wrapf("cannot unmarshal access token response: {{err}}", err)
+	}
+
+	return &retVal, nil
+}
@@ -0,0 +1,102 @@
+package mashery
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"time"
+)
+
+// V2 signature is the digest of the API key, the key secret, and the current time. Mashery uses hex-encoded MD5
+// digest salted with Epoch seconds; gateways implementing Mashery-style signature authentication may use a different
+// digest algorithm, encoding, or timestamp resolution. These are selected for each credentials.
+
+const (
+	secretSigAlgorithmField = "sig_algorithm"
+	secretSigEncodingField  = "sig_encoding"
+	secretSigTimestampField = "sig_timestamp"
+
+	sigAlgorithmMD5    = "md5"
+	sigAlgorithmSHA256 = "sha256"
+	sigEncodingHex     = "hex"
+	sigEncodingBase64  = "base64"
+	sigTimestampSecs   = "seconds"
+	sigTimestampMillis = "millis"
+)
+
+// v2Signer computes V2 signature of the key and secret salted with the time.
+type v2Signer interface {
+	Sign(apiKey string, secret string, t time.Time) string
+	// Timestamp the value the signature of the time is salted with.
+	Timestamp(t time.Time) int64
+}
+
+var v2SignatureAlgorithms = map[string]func() hash.Hash{
+	sigAlgorithmMD5:    md5.New,
+	sigAlgorithmSHA256: sha256.New,
+}
+
+var v2SignatureEncodings = map[string]func([]byte) string{
+	sigEncodingHex:    hex.EncodeToString,
+	sigEncodingBase64: base64.StdEncoding.EncodeToString,
+}
+
+var v2SignatureTimestamps = map[string]func(time.Time) int64{
+	sigTimestampSecs:   func(t time.Time) int64 { return t.Unix() },
+	sigTimestampMillis: func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) },
+}
+
+// digestSigner signs the concatenation of the key, the secret, and the timestamp with a digest algorithm.
+type digestSigner struct {
+	newHash   func() hash.Hash
+	encode    func([]byte) string
+	timestamp func(time.Time) int64
+}
+
+func (s digestSigner) Sign(apiKey string, secret string, t time.Time) string {
+	h := s.newHash()
+	h.Write([]byte(fmt.Sprintf("%s%s%d", apiKey, secret, s.Timestamp(t))))
+
+	return s.encode(h.Sum(nil))
+}
+
+func (s digestSigner) Timestamp(t time.Time) int64 {
+	return s.timestamp(t)
+}
+
+// v2SignerOf returns the signer selected for the credentials. Unspecified settings default to Mashery signature.
+func v2SignerOf(v3Rec *AuthRec) v2Signer {
+	retVal := digestSigner{
+		newHash:   md5.New,
+		encode:    hex.EncodeToString,
+		timestamp: v2SignatureTimestamps[sigTimestampSecs],
+	}
+
+	if f, ok := v2SignatureAlgorithms[v3Rec.SigAlgorithm]; ok {
+		retVal.newHash = f
+	}
+	if f, ok := v2SignatureEncodings[v3Rec.SigEncoding]; ok {
+		retVal.encode = f
+	}
+	if f, ok := v2SignatureTimestamps[v3Rec.SigTimestamp]; ok {
+		retVal.timestamp = f
+	}
+
+	return retVal
+}
+
+// validateV2Signer checks that the signature settings of the credentials are supported.
+func validateV2Signer(v3Rec *AuthRec, fe fieldErrors) {
+	if _, ok := v2SignatureAlgorithms[v3Rec.SigAlgorithm]; len(v3Rec.SigAlgorithm) > 0 && !ok {
+		fe.add(secretSigAlgorithmField, "must be %s or %s", sigAlgorithmMD5, sigAlgorithmSHA256)
+	}
+	if _, ok := v2SignatureEncodings[v3Rec.SigEncoding]; len(v3Rec.SigEncoding) > 0 && !ok {
+		fe.add(secretSigEncodingField, "must be %s or %s", sigEncodingHex, sigEncodingBase64)
+	}
+	if _, ok := v2SignatureTimestamps[v3Rec.SigTimestamp]; len(v3Rec.SigTimestamp) > 0 && !ok {
+		fe.add(secretSigTimestampField, "must be %s or %s", sigTimestampSecs, sigTimestampMillis)
+	}
+}
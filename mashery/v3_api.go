@@ -0,0 +1,246 @@
+package mashery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Minimal client of Mashery V3 REST API used to manage Mashery objects on behalf of the stored V3 credentials.
+// The client honours the endpoint and the transport settings of the credentials.
+
+type v3ObjectRef struct {
+	Id string `json:"id"`
+}
+
+type v3PackageKey struct {
+	Id      string       `json:"id,omitempty"`
+	Apikey  string       `json:"apikey,omitempty"`
+	Secret  string       `json:"secret,omitempty"`
+	Status  string       `json:"status,omitempty"`
+	Package *v3ObjectRef `json:"package,omitempty"`
+	Plan    *v3ObjectRef `json:"plan,omitempty"`
+}
+
+type v3ErrorResponse struct {
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+// v3ApiError the error response of the V3 API.
+type v3ApiError struct {
+	method     string
+	resource   string
+	statusCode int
+	message    string
+}
+
+func (e *v3ApiError) Error() string {
+	if len(e.message) > 0 {
+		return fmt.Sprintf("V3 API %s %s returned %d: %s", e.method, e.resource, e.statusCode, e.message)
+	}
+	return fmt.Sprintf("V3 API %s %s returned unexpected status code %d", e.method, e.resource, e.statusCode)
+}
+
+// rejectedByMashery whether the error is the response of Mashery definitely refusing the request, so that the
+// requested change is known not to be applied. Network errors, timeouts, throttling and server errors leave the
+// outcome of the request unknown.
+func rejectedByMashery(err error) bool {
+	if apiErr, ok := errwrap.GetType(err, &v3ApiError{}).(*v3ApiError); ok {
+		return apiErr.statusCode >= 400 && apiErr.statusCode < 500 &&
+			apiErr.statusCode != http.StatusRequestTimeout && apiErr.statusCode != http.StatusTooManyRequests
+	}
+	return false
+}
+
+type v3Api struct {
+	ctx         context.Context
+	client      *http.Client
+	transport   TransportRec
+	accessToken string
+}
+
+// withV3Api obtains the access token for the credentials and calls the function with the API client using it.
+// The access token is invalidated after the function returns.
+func (b *AuthPlugin) withV3Api(ctx context.Context, s logical.Storage, v3Rec *AuthRec, f func(api *v3Api) error) error {
+	if !sufficientForV3(v3Rec) {
+		return errors.New("credentials are not sufficient to call Mashery V3 API")
+	}
+
+	helper, err := b.oauthHelperOf(ctx, s, v3Rec)
+	if err != nil {
+		return err
+	}
+	cl, t, err := b.httpClientOf(ctx, s, v3Rec)
+	if err != nil {
+		return err
+	}
+
+	v3Credentials := v3Rec.asV3Credentials()
+	tkn, err := helper.RetrieveAccessTokenFor(&v3Credentials)
+	if err != nil {
+		return errwrap.Wrapf("access token was not granted: {{err}}", err)
+	}
+
+	defer func() {
+		// The token was required only for this operation and is invalidated immediately.
+		if _, err := helper.ExchangeRefreshToken(&v3Credentials, tkn.RefreshToken); err != nil {
+			b.Logger().Warn("Could not invalidate the access token obtained for V3 API call", "error", err)
+		}
+	}()
+
+	return f(&v3Api{
+		ctx:         ctx,
+		client:      cl,
+		transport:   t,
+		accessToken: tkn.AccessToken,
+	})
+}
+
+// call sends the request to the V3 API resource and unmarshals the response into out, unless out is nil.
+func (api *v3Api) call(method string, resource string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return errwrap.Wrapf("cannot marshal V3 API request: {{err}}", err)
+		}
+	}
+
+	resp, err := doWithRetry(api.ctx, api.client, api.transport, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, api.transport.v3Endpoint()+resource, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+api.accessToken)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return errwrap.Wrapf("V3 API call failed: {{err}}", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errwrap.Wrapf("failed to read V3 API response: {{err}}", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		v3Err := v3ErrorResponse{}
+		_ = json.Unmarshal(respBody, &v3Err)
+		return &v3ApiError{method: method, resource: resource, statusCode: resp.StatusCode, message: v3Err.ErrorMessage}
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return errwrap.Wrapf("cannot unmarshal V3 API response: {{err}}", err)
+		}
+	}
+
+	return nil
+}
+
+func (api *v3Api) createPackageKey(appId string, packageId string, planId string) (*v3PackageKey, error) {
+	retVal := v3PackageKey{}
+	err := api.call(http.MethodPost, fmt.Sprintf("/applications/%s/packageKeys", appId), v3PackageKey{
+		Package: &v3ObjectRef{Id: packageId},
+		Plan:    &v3ObjectRef{Id: planId},
+	}, &retVal)
+
+	return &retVal, err
+}
+
+func (api *v3Api) deletePackageKey(keyId string) error {
+	return api.call(http.MethodDelete, fmt.Sprintf("/packageKeys/%s", keyId), nil, nil)
+}
+
+type v3Member struct {
+	Id          string `json:"id,omitempty"`
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	DisplayName string `json:"displayName,omitempty"`
+	AreaStatus  string `json:"areaStatus,omitempty"`
+}
+
+type v3Application struct {
+	Id          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+func (api *v3Api) createMember(m v3Member) (*v3Member, error) {
+	retVal := v3Member{}
+	err := api.call(http.MethodPost, "/members", m, &retVal)
+
+	return &retVal, err
+}
+
+func (api *v3Api) deleteMember(memberId string) error {
+	return api.call(http.MethodDelete, fmt.Sprintf("/members/%s", memberId), nil, nil)
+}
+
+func (api *v3Api) createApplication(memberId string, app v3Application) (*v3Application, error) {
+	retVal := v3Application{}
+	err := api.call(http.MethodPost, fmt.Sprintf("/members/%s/applications", memberId), app, &retVal)
+
+	return &retVal, err
+}
+
+func (api *v3Api) deleteApplication(appId string) error {
+	return api.call(http.MethodDelete, fmt.Sprintf("/applications/%s", appId), nil, nil)
+}
+
+// findMemberByUsername returns the member with the specified username, or nil if there is no such member.
+func (api *v3Api) findMemberByUsername(username string) (*v3Member, error) {
+	var members []v3Member
+	resource := "/members?fields=id,username,email&filter=" + url.QueryEscape("username:"+username)
+	if err := api.call(http.MethodGet, resource, nil, &members); err != nil {
+		return nil, err
+	}
+
+	for _, m := range members {
+		if m.Username == username {
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+func (api *v3Api) changeMemberPassword(memberId string, newPassword string) error {
+	return api.call(http.MethodPut, fmt.Sprintf("/members/%s", memberId), map[string]string{
+		"id":        memberId,
+		"passwdNew": newPassword,
+	}, nil)
+}
+
+// findPackageKey returns the package key with the specified API key, including its secret, or nil if there is no
+// such key.
+func (api *v3Api) findPackageKey(apiKey string) (*v3PackageKey, error) {
+	var keys []v3PackageKey
+	resource := "/packageKeys?fields=id,apikey,secret&filter=" + url.QueryEscape("apikey:"+apiKey)
+	if err := api.call(http.MethodGet, resource, nil, &keys); err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		if k.Apikey == apiKey {
+			return &k, nil
+		}
+	}
+	return nil, nil
+}
+
+func (api *v3Api) changePackageKeySecret(keyId string, newSecret string) error {
+	return api.call(http.MethodPut, fmt.Sprintf("/packageKeys/%s", keyId), v3PackageKey{
+		Id:     keyId,
+		Secret: newSecret,
+	}, nil)
+}
@@ -0,0 +1,163 @@
+package mashery
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Validation of the credentials written to the mount. Violations are collected per field so that the administrator
+// can fix all of them at once.
+
+const (
+	secretFieldErrorsField = "field_errors"
+	transportFieldErrorKey = "transport"
+
+	// Upper bound of the QPS that can be stored with the credentials.
+	maxCredentialsQPS = 10000
+)
+
+// validCredentialsName matches the logical names accepted by the credentials paths. Names that do not reach the
+// mount through these paths, e.g. the names in imported bundles, are checked against it before these are used as
+// storage keys.
+var validCredentialsName = regexp.MustCompile("^" + framework.GenericNameWithAtRegex(credentialsName) + "$")
+
+// fieldErrors violations of the field constraints, keyed by the field name.
+type fieldErrors map[string]string
+
+func (fe fieldErrors) add(field string, format string, args ...interface{}) {
+	if _, exists := fe[field]; !exists {
+		fe[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+// asResponse error response listing the violations in the message and, structured, in field_errors.
+func (fe fieldErrors) asResponse() *logical.Response {
+	fields := make([]string, 0, len(fe))
+	for f := range fe {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	var msgs []string
+	for _, f := range fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f, fe[f]))
+	}
+
+	resp := logical.ErrorResponse("invalid credentials: %s", strings.Join(msgs, "; "))
+	resp.Data[secretFieldErrorsField] = map[string]string(fe)
+	return resp
+}
+
+// normalizeAuthRec trims the whitespace, e.g. trailing newlines of the values read from files, around the string
+// fields of the credentials.
+func normalizeAuthRec(v3Rec *AuthRec) {
+	v3Rec.AreaId = strings.TrimSpace(v3Rec.AreaId)
+	v3Rec.ApiKey = strings.TrimSpace(v3Rec.ApiKey)
+	v3Rec.KeySecret = strings.TrimSpace(v3Rec.KeySecret)
+	v3Rec.Username = strings.TrimSpace(v3Rec.Username)
+	v3Rec.Password = strings.TrimSpace(v3Rec.Password)
+}
+
+// validateAuthRec checks the constraints every stored credentials must satisfy.
+func validateAuthRec(v3Rec *AuthRec) fieldErrors {
+	retVal := fieldErrors{}
+
+	if len(v3Rec.AreaId) > 0 {
+		if _, err := uuid.ParseUUID(v3Rec.AreaId); err != nil {
+			retVal.add(secretAreaIdField, "must be a UUID")
+		}
+	}
+	if v3Rec.AreaNid < 0 {
+		retVal.add(secretAreaNidField, "must be positive")
+	}
+	if v3Rec.MaxQPS < 0 || v3Rec.MaxQPS > maxCredentialsQPS {
+		retVal.add(secretQpsField, "must be between 1 and %d", maxCredentialsQPS)
+	}
+	if v3Rec.LeaseDuration < 0 || v3Rec.LeaseDuration > maxV3TokenLife {
+		retVal.add(secretLeaseDurationField, "must be between 1 and %d seconds", maxV3TokenLife)
+	}
+	if v3Rec.PasswordRotationPeriod < 0 {
+		retVal.add(secretRotationPeriod, "must not be negative")
+	}
+	if err := validateTransport(v3Rec.TransportRec); err != nil {
+		retVal.add(transportFieldErrorKey, err.Error())
+	}
+	validateV2Signer(v3Rec, retVal)
+
+	return retVal
+}
+
+// clearableFields resets the stored value of each field that can be cleared on update.
+var clearableFields = map[string]func(v3Rec *AuthRec){
+	secretAreaIdField:  func(v3Rec *AuthRec) { v3Rec.AreaId = "" },
+	secretAreaNidField: func(v3Rec *AuthRec) { v3Rec.AreaNid = 0 },
+	secretApiKeField:   func(v3Rec *AuthRec) { v3Rec.ApiKey = "" },
+	secretKeySecretField: func(v3Rec *AuthRec) {
+		v3Rec.KeySecret = ""
+		v3Rec.PreviousKeySecret = ""
+		v3Rec.PreviousSecretValidUntil = 0
+		v3Rec.PendingKeySecret = ""
+	},
+	secretUsernameField: func(v3Rec *AuthRec) { v3Rec.Username = "" },
+	secretPasswordField: func(v3Rec *AuthRec) {
+		v3Rec.Password = ""
+		v3Rec.PendingPassword = ""
+	},
+	secretQpsField:              func(v3Rec *AuthRec) { v3Rec.MaxQPS = 0 },
+	secretLeaseDurationField:    func(v3Rec *AuthRec) { v3Rec.LeaseDuration = 0 },
+	secretRotationPeriod:        func(v3Rec *AuthRec) { v3Rec.PasswordRotationPeriod = 0 },
+	secretSigAlgorithmField:     func(v3Rec *AuthRec) { v3Rec.SigAlgorithm = "" },
+	secretSigEncodingField:      func(v3Rec *AuthRec) { v3Rec.SigEncoding = "" },
+	secretSigTimestampField:     func(v3Rec *AuthRec) { v3Rec.SigTimestamp = "" },
+	transportTokenEndpointField: func(v3Rec *AuthRec) { v3Rec.TokenEndpoint = "" },
+	transportV2EndpointField:    func(v3Rec *AuthRec) { v3Rec.V2Endpoint = "" },
+	transportV3EndpointField:    func(v3Rec *AuthRec) { v3Rec.V3Endpoint = "" },
+	transportProxyField:         func(v3Rec *AuthRec) { v3Rec.Proxy = "" },
+	transportCABundleField:      func(v3Rec *AuthRec) { v3Rec.CABundle = "" },
+	transportTimeoutField:       func(v3Rec *AuthRec) { v3Rec.Timeout = 0 },
+	transportMaxRetriesField:    func(v3Rec *AuthRec) { v3Rec.MaxRetries = 0 },
+	transportRetryWaitField:     func(v3Rec *AuthRec) { v3Rec.RetryWait = 0 },
+}
+
+// clearAuthRecFields removes the listed fields from the credentials. A field cannot be cleared and supplied in
+// the same request.
+func clearAuthRecFields(data *framework.FieldData, fields []string, v3Rec *AuthRec) fieldErrors {
+	retVal := fieldErrors{}
+
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		if clear, ok := clearableFields[f]; !ok {
+			retVal.add(secretClearFieldsField, "field '%s' cannot be cleared", f)
+		} else if _, supplied := data.GetOk(f); supplied {
+			retVal.add(f, "cannot be both supplied and cleared")
+		} else {
+			clear(v3Rec)
+		}
+	}
+
+	return retVal
+}
+
+// validateAuthRecFields checks, in addition to validateAuthRec, the values supplied in the write request. Unlike
+// the stored credentials, where zero means that the value is not specified, the supplied values must be meaningful.
+func validateAuthRecFields(data *framework.FieldData, v3Rec *AuthRec) fieldErrors {
+	retVal := validateAuthRec(v3Rec)
+
+	for _, f := range []string{secretAreaIdField, secretApiKeField, secretKeySecretField, secretUsernameField, secretPasswordField} {
+		if raw, ok := data.GetOk(f); ok && len(strings.TrimSpace(raw.(string))) == 0 {
+			retVal.add(f, "must not be empty")
+		}
+	}
+	for _, f := range []string{secretAreaNidField, secretQpsField, secretLeaseDurationField} {
+		if raw, ok := data.GetOk(f); ok && raw.(int) <= 0 {
+			retVal.add(f, "must be positive")
+		}
+	}
+
+	return retVal
+}
@@ -0,0 +1,370 @@
+// Package masherystub implements a local stand-in for the Mashery V3 token endpoint and the V2 JSON-RPC API.
+//
+// The stub issues and refreshes V3 access tokens for the package keys and users registered with it, and verifies
+// V2 signatures the way Mashery does. Throttling and outages of Mashery can be simulated. The stub is an
+// http.Handler; it is served with net/http/httptest in tests, or with the masherystub command for offline
+// development.
+package masherystub
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TokenPath path of the V3 token endpoint.
+	TokenPath = "/v3/token"
+	// V2Path path of the V2 JSON-RPC API base URL; the area numeric id follows it.
+	V2Path = "/v2/json-rpc"
+
+	// DefaultTokenLife lifetime of the issued V3 access tokens, same as in Mashery.
+	DefaultTokenLife = time.Hour
+	// DefaultSignatureWindow time difference within which V2 signatures are accepted.
+	DefaultSignatureWindow = 5 * time.Minute
+
+	masheryErrorCodeHeader = "X-Mashery-Error-Code"
+)
+
+// PackageKey package key accepted by the stub. V2 signatures of the key are accepted only for the area with
+// the specified numeric id.
+type PackageKey struct {
+	ApiKey  string
+	Secret  string
+	AreaNid int
+}
+
+// User Mashery user that can be granted V3 access tokens for the area with the specified UUID.
+type User struct {
+	Username string
+	Password string
+	AreaId   string
+}
+
+type issuedToken struct {
+	apiKey       string
+	username     string
+	areaId       string
+	refreshToken string
+	expiry       time.Time
+}
+
+// tokenResponse the body of Mashery token endpoint response.
+type tokenResponse struct {
+	TokenType    string `json:"token_type"`
+	ApiKey       string `json:"mapi"`
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	Result interface{} `json:"result"`
+	Error  *rpcError   `json:"error"`
+	Id     interface{} `json:"id"`
+}
+
+// Stub local stand-in for Mashery. The zero value is not usable; use New.
+type Stub struct {
+	mu sync.Mutex
+
+	keys  map[string]PackageKey
+	users map[string]User
+	// Issued access tokens, and the access tokens keyed by their refresh tokens.
+	tokens        map[string]issuedToken
+	refreshTokens map[string]string
+
+	tokenLife       time.Duration
+	signatureWindow time.Duration
+	clockSkew       time.Duration
+
+	throttled int
+	failing   int
+
+	tokenRequests int
+	v2Requests    int
+}
+
+// New creates the stub without any package keys and users.
+func New() *Stub {
+	return &Stub{
+		keys:            map[string]PackageKey{},
+		users:           map[string]User{},
+		tokens:          map[string]issuedToken{},
+		refreshTokens:   map[string]string{},
+		tokenLife:       DefaultTokenLife,
+		signatureWindow: DefaultSignatureWindow,
+	}
+}
+
+// AddPackageKey registers the package key, replacing the key with the same API key.
+func (s *Stub) AddPackageKey(k PackageKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[k.ApiKey] = k
+}
+
+// AddUser registers the user, replacing the user with the same name.
+func (s *Stub) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[u.Username] = u
+}
+
+// SetTokenLife sets the lifetime of the access tokens issued from now on.
+func (s *Stub) SetTokenLife(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokenLife = d
+}
+
+// SetClockSkew shifts the time of the stub from the local time. The shifted time is reported in the Date header
+// and is used to verify V2 signatures.
+func (s *Stub) SetClockSkew(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clockSkew = d
+}
+
+// Throttle rejects the next n requests with 429 Too Many Requests, as Mashery does when the key exceeds its QPS.
+func (s *Stub) Throttle(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.throttled = n
+}
+
+// Fail rejects the next n requests with 503 Service Unavailable.
+func (s *Stub) Fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failing = n
+}
+
+// AccessTokenValid whether the access token was issued by the stub, was not invalidated by the exchange of its
+// refresh token, and has not expired.
+func (s *Stub) AccessTokenValid(accessToken string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tkn, ok := s.tokens[accessToken]
+	return ok && s.now().Before(tkn.expiry)
+}
+
+// TokenRequests number of requests received by the token endpoint, including the rejected ones.
+func (s *Stub) TokenRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokenRequests
+}
+
+// V2Requests number of requests received by the V2 API, including the rejected ones.
+func (s *Stub) V2Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.v2Requests
+}
+
+// Sign computes Mashery V2 signature of the key and secret salted with the specified time.
+func Sign(apiKey string, secret string, t time.Time) string {
+	digest := md5.Sum([]byte(fmt.Sprintf("%s%s%d", apiKey, secret, t.Unix())))
+	return hex.EncodeToString(digest[:])
+}
+
+func (s *Stub) now() time.Time {
+	return time.Now().Add(s.clockSkew)
+}
+
+func (s *Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// net/http only sets the Date header if the handler did not.
+	w.Header().Set("Date", s.now().UTC().Format(http.TimeFormat))
+
+	isToken := r.URL.Path == TokenPath
+	isV2 := r.URL.Path == V2Path || strings.HasPrefix(r.URL.Path, V2Path+"/")
+	if isToken {
+		s.tokenRequests++
+	} else if isV2 {
+		s.v2Requests++
+	}
+
+	if s.throttled > 0 {
+		s.throttled--
+		w.Header().Set(masheryErrorCodeHeader, "ERR_429_DEVELOPER_OVER_QPS")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Developer Over Qps", http.StatusTooManyRequests)
+		return
+	} else if s.failing > 0 {
+		s.failing--
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodHead:
+		// Used by the clients to learn the server time from the Date header.
+		w.WriteHeader(http.StatusOK)
+	case isToken && r.Method == http.MethodPost:
+		s.serveToken(w, r)
+	case isV2 && r.Method == http.MethodPost:
+		s.serveV2(w, r)
+	case isToken || isV2:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func oauthError(w http.ResponseWriter, status int, code string, desc string) {
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": desc,
+	})
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *Stub) serveToken(w http.ResponseWriter, r *http.Request) {
+	apiKey, secret, ok := r.BasicAuth()
+	if key, known := s.keys[apiKey]; !ok || !known || key.Secret != secret {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Mashery"`)
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	var issued issuedToken
+	switch grant := r.PostForm.Get("grant_type"); grant {
+	case "password":
+		user, known := s.users[r.PostForm.Get("username")]
+		if !known || user.Password != r.PostForm.Get("password") {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid username or password")
+			return
+		} else if user.AreaId != r.PostForm.Get("scope") {
+			oauthError(w, http.StatusBadRequest, "invalid_scope", "User has no access to the requested area")
+			return
+		}
+		issued = issuedToken{apiKey: apiKey, username: user.Username, areaId: user.AreaId}
+	case "refresh_token":
+		accessToken, known := s.refreshTokens[r.PostForm.Get("refresh_token")]
+		if !known || s.tokens[accessToken].apiKey != apiKey {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+			return
+		}
+
+		// The refresh token is used once; the access token it was issued with is invalidated.
+		issued = s.tokens[accessToken]
+		delete(s.refreshTokens, issued.refreshToken)
+		delete(s.tokens, accessToken)
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("Grant type '%s' is not supported", grant))
+		return
+	}
+
+	accessToken := randomToken()
+	issued.refreshToken = randomToken()
+	issued.expiry = s.now().Add(s.tokenLife)
+	s.tokens[accessToken] = issued
+	s.refreshTokens[issued.refreshToken] = accessToken
+
+	writeJSON(w, http.StatusOK, tokenResponse{
+		TokenType:    "bearer",
+		ApiKey:       apiKey,
+		AccessToken:  accessToken,
+		ExpiresIn:    int(s.tokenLife / time.Second),
+		RefreshToken: issued.refreshToken,
+		Scope:        issued.areaId,
+	})
+}
+
+// signatureValid whether the signature was computed within the signature window from the current time.
+func (s *Stub) signatureValid(key PackageKey, sig string) bool {
+	now := s.now()
+	for d := -s.signatureWindow; d <= s.signatureWindow; d += time.Second {
+		if Sign(key.ApiKey, key.Secret, now.Add(d)) == sig {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Stub) serveV2(w http.ResponseWriter, r *http.Request) {
+	nid, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, V2Path+"/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	key, known := s.keys[r.URL.Query().Get("apikey")]
+	if !known {
+		w.Header().Set(masheryErrorCodeHeader, "ERR_403_DEVELOPER_INACTIVE")
+		http.Error(w, "Developer Inactive", http.StatusForbidden)
+		return
+	} else if key.AreaNid != nid || !s.signatureValid(key, r.URL.Query().Get("sig")) {
+		w.Header().Set(masheryErrorCodeHeader, "ERR_403_NOT_AUTHORIZED")
+		http.Error(w, "Not Authorized", http.StatusForbidden)
+		return
+	}
+
+	call := struct {
+		Method string      `json:"method"`
+		Id     interface{} `json:"id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+		writeJSON(w, http.StatusOK, rpcResponse{Error: &rpcError{Code: -32700, Message: "Parse error"}})
+		return
+	} else if call.Method != "object.query" {
+		writeJSON(w, http.StatusOK, rpcResponse{Error: &rpcError{Code: -32601, Message: "Method not found"}, Id: call.Id})
+		return
+	}
+
+	// Queries are answered with an empty result set.
+	writeJSON(w, http.StatusOK, rpcResponse{
+		Result: map[string]interface{}{
+			"total_items":    0,
+			"total_pages":    0,
+			"items_per_page": 100,
+			"current_page":   1,
+			"items":          []interface{}{},
+		},
+		Id: call.Id,
+	})
+}